@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A label matcher, key=value or key!=value
+type labelMatcher struct {
+	key    string
+	value  string
+	negate bool
+}
+
+// LabelFilter selects the nodes whose labels match all of its matchers.
+type LabelFilter []labelMatcher
+
+// Parse a comma separated list of key=value and key!=value matchers.
+func ParseLabelFilter(s string) (LabelFilter, error) {
+	var filter LabelFilter
+	for _, expr := range strings.Split(s, ",") {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			continue
+		}
+		var m labelMatcher
+		kv := strings.SplitN(expr, "!=", 2)
+		if len(kv) == 2 {
+			m.negate = true
+		} else {
+			kv = strings.SplitN(expr, "=", 2)
+		}
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid label filter: %s", expr)
+		}
+		m.key = strings.TrimSpace(kv[0])
+		m.value = strings.TrimSpace(kv[1])
+		filter = append(filter, m)
+	}
+	return filter, nil
+}
+
+// Parse a comma separated list of label keys to group by.
+func ParseGroupBy(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var keys []string
+	for _, key := range strings.Split(s, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("Invalid label to group by: %q", s)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (f LabelFilter) Match(labels map[string]string) bool {
+	for _, m := range f {
+		if (labels[m.key] == m.value) == m.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// NodeGroup is the nodes sharing the values of the group by labels, with
+// their aggregated state.
+type NodeGroup struct {
+	Labels map[string]string `json:"labels"`
+	Total  int               `json:"total"`
+	Free   int               `json:"free"`
+	Weight int               `json:"weight"`
+	Nodes  []NodeStatus      `json:"nodes"`
+}
+
+// Group the nodes by the values of the given labels. A node without one of
+// the labels is grouped with an empty value for it. Groups are sorted by
+// their label values.
+func GroupNodes(nodes []NodeStatus, keys []string) []NodeGroup {
+	groups := make(map[string]*NodeGroup)
+	var ids []string
+	for _, node := range nodes {
+		labels := make(map[string]string)
+		var values []string
+		for _, key := range keys {
+			labels[key] = node.Labels[key]
+			values = append(values, node.Labels[key])
+		}
+		id := strings.Join(values, "\x00")
+
+		g, ok := groups[id]
+		if !ok {
+			g = &NodeGroup{Labels: labels}
+			groups[id] = g
+			ids = append(ids, id)
+		}
+		g.Total++
+		if node.Free {
+			g.Free++
+		}
+		g.Weight += node.Weight
+		g.Nodes = append(g.Nodes, node)
+	}
+
+	sort.Strings(ids)
+	var out []NodeGroup
+	for _, id := range ids {
+		out = append(out, *groups[id])
+	}
+	return out
+}
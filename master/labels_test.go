@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGroupBy(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected []string
+		err      bool
+	}{
+		{s: ""},
+		{s: " "},
+		{s: "datacenter", expected: []string{"datacenter"}},
+		{s: "datacenter, rack", expected: []string{"datacenter", "rack"}},
+		{s: " datacenter ,rack ", expected: []string{"datacenter", "rack"}},
+		{s: "datacenter,,rack", err: true},
+		{s: "datacenter,", err: true},
+	}
+
+	for _, test := range tests {
+		keys, err := ParseGroupBy(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", test.s, keys)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("%q: got %q, expected %q", test.s, keys, test.expected)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"golang.org/x/oauth2/clientcredentials"
@@ -24,11 +26,23 @@ var (
 
 	pullerInterval = flag.Duration("puller-interval", 1*time.Second, "Interval used to pull metrics.")
 
+	// TLS
+	pullerCert = flag.String("puller-cert", "", "Client certificate to present to nodes requiring one.")
+	pullerKey  = flag.String("puller-key", "", "Key of the client certificate.")
+	pullerCA   = flag.String("puller-ca", "", "CA bundle to verify node certificates against, instead of the system roots.")
+
+	// Signing
+	signatureMaxAge = flag.Duration("signature-max-age", 30*time.Second, "Maximum age of signed statuses from nodes with a signing key.")
+
 	pusherEnable   = flag.Bool("pusher-enable", false, "Enable metrics push.")
 	pusherInterval = flag.Duration("pusher-interval", 1*time.Second, "Interval used to push metrics.")
 	pusherUrl      = flag.String("pusher-url", "https://example.com/", "URL to push metrics.")
 	pusherAuth     = flag.String("pusher-auth", "basic", "Authentication machanism to use when pushing metrics [basic, oauth].")
 
+	// Labels
+	pusherFilter  = flag.String("pusher-filter", "", "Only push the nodes with matching labels, as a comma separated list of key=value and key!=value.")
+	pusherGroupBy = flag.String("pusher-group-by", "", "Comma separated list of labels to group the pushed nodes by, with the number of nodes, free nodes and the total weight of each group.")
+
 	// Basic auth
 	pusherUsername = flag.String("pusher-username", os.Getenv("AUTH_USERNAME"), "Basic auth username to use when pushing metrics. The default value is read from the environment variable AUTH_USERNAME.")
 	pusherPassword = flag.String("pusher-password", os.Getenv("AUTH_PASSWORD"), "Basic auth password to use when pushing metrics. The default value is read from the environment variable AUTH_PASSWORD.")
@@ -40,18 +54,26 @@ var (
 )
 
 type NodeStatus struct {
-	Free           bool    `json:"free"`
-	Reason         string  `json:"reason"`
-	Load1          float64 `json:"load1,omitempty"`
-	Load5          float64 `json:"load5,omitempty"`
-	Load15         float64 `json:"load15,omitempty"`
-	Net            string  `json:"net,omitempty"`
-	NetThreshold   string  `json:"net-threshold"`
-	NetUtilization uint64  `json:"net-utilization"`
-	Time           int64   `json:"time,omitempty"`
-	Uptime         int     `json:"uptime,omitempty"`
-	Name           string  `json:"name"`
-	Hostname       string  `json:"hostname,omitempty"`
+	Free           bool              `json:"free"`
+	Reason         string            `json:"reason"`
+	Load1          float64           `json:"load1,omitempty"`
+	Load5          float64           `json:"load5,omitempty"`
+	Load15         float64           `json:"load15,omitempty"`
+	Net            string            `json:"net,omitempty"`
+	NetThreshold   string            `json:"net-threshold"`
+	NetUtilization uint64            `json:"net-utilization"`
+	Weight         int               `json:"weight"`
+	Time           int64             `json:"time,omitempty"`
+	Uptime         int               `json:"uptime,omitempty"`
+	Name           string            `json:"name"`
+	Hostname       string            `json:"hostname,omitempty"`
+	NodeID         string            `json:"node-id,omitempty"`
+	NodeIDMismatch bool              `json:"node-id-mismatch,omitempty"`
+	BootID         string            `json:"boot-id,omitempty"`
+	MachineID      string            `json:"machine-id,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	StartTime      int64             `json:"start-time,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
 }
 
 // Reset the nodestatus values, for example useful on connection failures.
@@ -63,11 +85,16 @@ func (s *NodeStatus) Reset() {
 	s.Load15 = 0
 	s.Net = ""
 	s.NetUtilization = 0
+	s.Weight = 0
+	s.NodeID = ""
+	s.NodeIDMismatch = false
+	s.Labels = nil
 }
 
 type NodeConfig struct {
-	Name string `json:"name"`
-	Url  string `json:"url"`
+	Name     string    `json:"name"`
+	Url      string    `json:"url"`
+	Verifier *Verifier `json:"-"`
 }
 
 func readConfiguration(path *string, group *string) ([]NodeConfig, error) {
@@ -80,6 +107,10 @@ func readConfiguration(path *string, group *string) ([]NodeConfig, error) {
 
 	var nodes []NodeConfig
 	for _, section := range cfgIni.Sections() {
+		// Not nodes, but their keys
+		if section.Name() == "signing-keys" {
+			continue
+		}
 		for _, entry := range cfgIni.Section(section.Name()).Keys() {
 			var node NodeConfig
 			node.Url = entry.Value()
@@ -87,10 +118,52 @@ func readConfiguration(path *string, group *string) ([]NodeConfig, error) {
 			nodes = append(nodes, node)
 		}
 	}
+
+	// Statuses of nodes with a signing key must be signed with it
+	for _, entry := range cfgIni.Section("signing-keys").Keys() {
+		found := false
+		for i := range nodes {
+			if nodes[i].Name != entry.Name() {
+				continue
+			}
+			verifier, err := LoadVerifier(entry.Value())
+			if err != nil {
+				return nil, fmt.Errorf("Failed to load signing key for %s: %s\n", entry.Name(), err.Error())
+			}
+			nodes[i].Verifier = verifier
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("Signing key for unknown node %s\n", entry.Name())
+		}
+	}
 	return nodes, nil
 }
 
-func StatusPuller(node NodeConfig, status *sync.Map) {
+// Create the TLS configuration used to connect to nodes over HTTPS.
+func pullerTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if *pullerCert != "" {
+		cert, err := tls.LoadX509KeyPair(*pullerCert, *pullerKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if *pullerCA != "" {
+		pem, err := ioutil.ReadFile(*pullerCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", *pullerCA)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func StatusPuller(node NodeConfig, status *sync.Map, tlsConfig *tls.Config) {
 	tr := &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   4 * time.Second,
@@ -99,6 +172,7 @@ func StatusPuller(node NodeConfig, status *sync.Map) {
 		MaxIdleConns:        5,
 		IdleConnTimeout:     10 * time.Second,
 		TLSHandshakeTimeout: 2 * time.Second,
+		TLSClientConfig:     tlsConfig,
 		DisableCompression:  false,
 	}
 	client := &http.Client{
@@ -111,6 +185,15 @@ func StatusPuller(node NodeConfig, status *sync.Map) {
 	s.Reason = "Initializing"
 	status.Store(node.Name, s)
 
+	// ETag of the last status, which is current as long as the node responds
+	// with 304. It is only kept after a successful pull.
+	var etag string
+
+	// Identity of the last boot and process of the node, to tell reboots and
+	// restarts. They are kept when the node can not be reached.
+	var bootID string
+	var startTime int64
+
 	for {
 		sleep := *pullerInterval + time.Duration(rand.Intn(100))*time.Millisecond
 		time.Sleep(sleep)
@@ -126,6 +209,11 @@ func StatusPuller(node NodeConfig, status *sync.Map) {
 		}
 		req.Header.Set("User-Agent", "NodeStatusPuller/1.0.0")
 		req.Header.Set("Accept-Encoding", "gzip")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		previousEtag := etag
+		etag = ""
 		resp, err := client.Do(req)
 		if err != nil {
 			fmt.Printf("Puller for %s error: %s\n", node.Name, err.Error())
@@ -138,7 +226,25 @@ func StatusPuller(node NodeConfig, status *sync.Map) {
 		if *debug {
 			fmt.Printf("Puller for %s completed with status %s\n", node.Name, resp.Status)
 		}
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		if resp.StatusCode == http.StatusNotModified && previousEtag != "" {
+			resp.Body.Close()
+			// The node signs the ETag of a 304, so that it can not be used to
+			// keep an old status
+			if node.Verifier != nil {
+				if err := node.Verifier.Verify(resp.Header.Get("X-Node-Signature"), []byte(previousEtag), time.Now()); err != nil {
+					fmt.Printf("Puller for %s signature verification failed: %s\n", node.Name, err.Error())
+					s.Reset()
+					s.Reason = "Signature verification failed"
+					status.Store(node.Name, s)
+					continue
+				}
+			}
+			etag = previousEtag
+			status.Store(node.Name, s)
+			continue
+		}
+		// Nodes may respond with 503 or 429 when not free, still with a status
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests {
 			s.Reset()
 			s.Reason = "Invalid response code (" + resp.Status + ")"
 			status.Store(node.Name, s)
@@ -175,6 +281,25 @@ func StatusPuller(node NodeConfig, status *sync.Map) {
 
 		elapsed := time.Since(t0).Seconds()
 		fmt.Printf("Puller for %s fetched %db in %.2fs\n", node.Name, len(body), elapsed)
+		if node.Verifier != nil {
+			if err := node.Verifier.Verify(resp.Header.Get("X-Node-Signature"), body, time.Now()); err != nil {
+				fmt.Printf("Puller for %s signature verification failed: %s\n", node.Name, err.Error())
+				s.Reset()
+				s.Reason = "Signature verification failed"
+				status.Store(node.Name, s)
+				continue
+			}
+		}
+		// The identity is not kept from the previous status, as older nodes
+		// do not send it
+		mismatch := s.NodeIDMismatch
+		s.NodeID = ""
+		s.NodeIDMismatch = false
+		s.BootID = ""
+		s.MachineID = ""
+		s.Version = ""
+		s.StartTime = 0
+		s.Labels = nil
 		if err := json.Unmarshal(body, &s); err != nil {
 			fmt.Printf("Puller for %s error: %s\n", node.Name, err.Error())
 			s.Reset()
@@ -185,20 +310,49 @@ func StatusPuller(node NodeConfig, status *sync.Map) {
 		if *debug {
 			fmt.Printf("Puller for %s got: %s\n", node.Name, string(body))
 		}
+
+		// A node answering for another one, for example because of a DNS
+		// mistake, is not trusted with the traffic of this one
+		if s.NodeID != "" && s.NodeID != node.Name {
+			if !mismatch {
+				fmt.Printf("Puller for %s got the status of node %s\n", node.Name, s.NodeID)
+			}
+			s.NodeIDMismatch = true
+			s.Free = false
+			s.Weight = 0
+			s.Reason = "Node ID mismatch (" + s.NodeID + ")"
+		}
+
+		// The boot and process of another node are not those of this one
+		if !s.NodeIDMismatch {
+			if bootID != "" && s.BootID != "" && s.BootID != bootID {
+				fmt.Printf("Event: node %s rebooted\n", node.Name)
+			} else if startTime != 0 && s.StartTime != 0 && s.StartTime != startTime {
+				fmt.Printf("Event: node %s restarted\n", node.Name)
+			}
+			if s.BootID != "" {
+				bootID = s.BootID
+			}
+			if s.StartTime != 0 {
+				startTime = s.StartTime
+			}
+		}
+
+		etag = resp.Header.Get("ETag")
 		status.Store(node.Name, s)
 	}
 }
 
-func StatusPusherWrapper(nodes []NodeConfig, status *sync.Map) {
+func StatusPusherWrapper(nodes []NodeConfig, status *sync.Map, filter LabelFilter, groupBy []string) {
 	for {
-		err := StatusPusher(nodes, status)
+		err := StatusPusher(nodes, status, filter, groupBy)
 		if err != nil {
 			fmt.Printf("Restarting pusher due to: %s\n", err.Error())
 		}
 	}
 }
 
-func StatusPusher(nodes []NodeConfig, status *sync.Map) error {
+func StatusPusher(nodes []NodeConfig, status *sync.Map, filter LabelFilter, groupBy []string) error {
 	tr := &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   5 * time.Second,
@@ -229,12 +383,17 @@ func StatusPusher(nodes []NodeConfig, status *sync.Map) error {
 
 		var all []NodeStatus
 		for _, node := range nodes {
-			if s, loaded := status.Load(node.Name); loaded {
+			if s, loaded := status.Load(node.Name); loaded && filter.Match(s.(NodeStatus).Labels) {
 				all = append(all, s.(NodeStatus))
 			}
 		}
 
-		out, err := json.MarshalIndent(all, "", "    ")
+		var payload interface{} = all
+		if len(groupBy) > 0 {
+			payload = GroupNodes(all, groupBy)
+		}
+
+		out, err := json.MarshalIndent(payload, "", "    ")
 		if err != nil {
 			fmt.Printf("%s\n", err.Error())
 			continue
@@ -304,13 +463,29 @@ func main() {
 		os.Exit(2)
 	}
 
+	tlsConfig, err := pullerTLSConfig()
+	if err != nil {
+		fmt.Printf("Failed to set up TLS: %s\n", err.Error())
+		os.Exit(2)
+	}
+
 	status := new(sync.Map)
 	for _, node := range nodes {
-		go StatusPuller(node, status)
+		go StatusPuller(node, status, tlsConfig)
 	}
 
 	if *pusherEnable {
-		go StatusPusherWrapper(nodes, status)
+		filter, err := ParseLabelFilter(*pusherFilter)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(2)
+		}
+		groupBy, err := ParseGroupBy(*pusherGroupBy)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(2)
+		}
+		go StatusPusherWrapper(nodes, status, filter, groupBy)
 	}
 
 	// Block here
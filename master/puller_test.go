@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusPullerNotModified(t *testing.T) {
+	*pullerInterval = 10 * time.Millisecond
+
+	// The node serves the first body, then 304 for it, then a second body
+	// and 304 for that
+	bodies := []string{
+		`{"free": true, "reason": "Normal operation", "weight": 80, "time": 100, "uptime": 10}`,
+		`{"free": false, "reason": "Maintenance mode", "weight": 0, "time": 102, "uptime": 12}`,
+	}
+	status := new(sync.Map)
+	var lock sync.Mutex
+	var conditional []string
+	// The status of the master at each request, from the previous response
+	var seen []NodeStatus
+	done := make(chan struct{})
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if len(seen) == 5 {
+			return
+		}
+		s, _ := status.Load("n1")
+		seen = append(seen, s.(NodeStatus))
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		if len(seen) == 5 {
+			close(done)
+			return
+		}
+
+		i := (len(seen) - 1) / 2
+		etag := `"e-` + strconv.Itoa(i) + `-json"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(bodies[i]))
+	}))
+	defer node.Close()
+
+	go StatusPuller(NodeConfig{Name: "n1", Url: node.URL}, status, nil)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []string{"", `"e-0-json"`, `"e-0-json"`, `"e-1-json"`, `"e-1-json"`}
+	for i, etag := range expected {
+		if conditional[i] != etag {
+			t.Errorf("request %d: got If-None-Match %q, expected %q", i+1, conditional[i], etag)
+		}
+	}
+
+	// After the first body, and after the 304 for it
+	for _, s := range seen[1:3] {
+		if !s.Free || s.Weight != 80 || s.Time != 100 || s.Uptime != 10 {
+			t.Errorf("first body: got %+v", s)
+		}
+	}
+	// After the second body, and after the 304 for it
+	for _, s := range seen[3:5] {
+		if s.Free || s.Reason != "Maintenance mode" || s.Time != 102 || s.Uptime != 12 {
+			t.Errorf("second body: got %+v", s)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verifier checks the signatures of the statuses of a node, made with a key
+// shared with the node (hmac-sha256) or with the private key of the node
+// (ed25519). It is only used by the puller of the node.
+type Verifier struct {
+	Algorithm string
+	secret    []byte
+	publicKey ed25519.PublicKey
+
+	// Nonces seen within the maximum age, to reject replayed statuses
+	nonces map[string]time.Time
+}
+
+// Load a verification key given as <algorithm>:<path>. An hmac-sha256 key is
+// the content of the file, an ed25519 key a PEM public key.
+func LoadVerifier(spec string) (*Verifier, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid signing key, expected <algorithm>:<path>: %s", spec)
+	}
+	data, err := ioutil.ReadFile(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verifier{Algorithm: parts[0], nonces: make(map[string]time.Time)}
+	switch v.Algorithm {
+	case "hmac-sha256":
+		v.secret = bytes.TrimSpace(data)
+		if len(v.secret) == 0 {
+			return nil, fmt.Errorf("Empty key in %s", parts[1])
+		}
+	case "ed25519":
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("No PEM data in %s", parts[1])
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Not an Ed25519 key in %s", parts[1])
+		}
+		v.publicKey = publicKey
+	default:
+		return nil, fmt.Errorf("Unknown signing algorithm: %s", v.Algorithm)
+	}
+	return v, nil
+}
+
+// Verify the X-Node-Signature header of a status body. The signature must be
+// recent, and its nonce not seen before.
+func (v *Verifier) Verify(header string, body []byte, now time.Time) error {
+	if header == "" {
+		return errors.New("Unsigned status")
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	if fields["alg"] != v.Algorithm {
+		return fmt.Errorf("Unexpected algorithm %s", fields["alg"])
+	}
+	ts, err := strconv.ParseInt(fields["ts"], 10, 64)
+	if err != nil {
+		return errors.New("Invalid timestamp")
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > *signatureMaxAge || age < -*signatureMaxAge {
+		return fmt.Errorf("Timestamp off by %s", age)
+	}
+	nonce := fields["nonce"]
+	if nonce == "" {
+		return errors.New("Missing nonce")
+	}
+	if _, ok := v.nonces[nonce]; ok {
+		return errors.New("Replayed nonce")
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields["sig"])
+	if err != nil {
+		return errors.New("Invalid signature encoding")
+	}
+
+	msg := append([]byte(fields["ts"]+"\n"+nonce+"\n"), body...)
+	if v.secret != nil {
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(msg)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("Invalid signature")
+		}
+	} else if !ed25519.Verify(v.publicKey, msg, sig) {
+		return errors.New("Invalid signature")
+	}
+
+	// Only remember the nonces that could still pass the timestamp check
+	for n, seen := range v.nonces {
+		if now.Sub(seen) > 2**signatureMaxAge {
+			delete(v.nonces, n)
+		}
+	}
+	v.nonces[nonce] = now
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// sign makes the X-Node-Signature header as the server does.
+func sign(alg string, key interface{}, ts int64, nonce string, body []byte) string {
+	msg := append([]byte(strconv.FormatInt(ts, 10)+"\n"+nonce+"\n"), body...)
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(msg)
+		sig = mac.Sum(nil)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, msg)
+	}
+	return fmt.Sprintf("alg=%s, ts=%d, nonce=%s, sig=%s", alg, ts, nonce, base64.StdEncoding.EncodeToString(sig))
+}
+
+func writeKey(t *testing.T, dir string, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := []byte("shared secret")
+	hmacPath := writeKey(t, dir, "hmac.key", append(secret, '\n'))
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Path := writeKey(t, dir, "ed25519.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	body := []byte(`{"free": true}`)
+	keys := []struct {
+		alg   string
+		spec  string
+		key   interface{}
+		wrong interface{}
+	}{
+		{"hmac-sha256", "hmac-sha256:" + hmacPath, secret, []byte("other secret")},
+		{"ed25519", "ed25519:" + ed25519Path, privateKey, otherKey},
+	}
+
+	for _, k := range keys {
+		v, err := LoadVerifier(k.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name   string
+			header string
+			body   []byte
+			valid  bool
+		}{
+			{"valid", sign(k.alg, k.key, now.Unix(), "n1", body), body, true},
+			{"replayed nonce", sign(k.alg, k.key, now.Unix(), "n1", body), body, false},
+			{"valid ETag of a 304", sign(k.alg, k.key, now.Unix(), "n2", []byte(`"e-1-json"`)), []byte(`"e-1-json"`), true},
+			{"other ETag", sign(k.alg, k.key, now.Unix(), "n3", []byte(`"e-1-json"`)), []byte(`"e-2-json"`), false},
+			{"expired timestamp", sign(k.alg, k.key, now.Add(-time.Minute).Unix(), "n4", body), body, false},
+			{"future timestamp", sign(k.alg, k.key, now.Add(time.Minute).Unix(), "n5", body), body, false},
+			{"tampered body", sign(k.alg, k.key, now.Unix(), "n6", body), []byte(`{"free": false}`), false},
+			{"wrong key", sign(k.alg, k.wrong, now.Unix(), "n7", body), body, false},
+			{"unsigned", "", body, false},
+			{"missing nonce", sign(k.alg, k.key, now.Unix(), "", body), body, false},
+		}
+		for _, test := range tests {
+			err := v.Verify(test.header, test.body, now)
+			if test.valid && err != nil {
+				t.Errorf("%s %s: %v", k.alg, test.name, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("%s %s: expected an error", k.alg, test.name)
+			}
+		}
+
+		// A valid signature with the algorithm of the other key
+		other := "ed25519"
+		if k.alg == other {
+			other = "hmac-sha256"
+		}
+		if err := v.Verify(sign(other, k.key, now.Unix(), "n8", body), body, now); err == nil {
+			t.Errorf("%s: expected an error for algorithm %s", k.alg, other)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerStats counts the requests turned away by a listener.
+type ListenerStats struct {
+	Blocked uint64
+	Limited uint64
+}
+
+// Stats of each listener, by name
+var listenerStats sync.Map
+
+func statsFor(name string) *ListenerStats {
+	stats, _ := listenerStats.LoadOrStore(name, &ListenerStats{})
+	return stats.(*ListenerStats)
+}
+
+// parseCIDRs parses a comma separated list of networks. A single address is
+// taken as a network of its own.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("invalid address: " + cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true if the client may use the listener: it is not in the
+// deny list, and in the allow list if there is one.
+func (l *ListenerConfig) Allowed(ip net.IP) bool {
+	if contains(l.Deny, ip) {
+		return false
+	}
+	return len(l.Allow) == 0 || contains(l.Allow, ip)
+}
+
+// RateLimiter is a token bucket per client, refilled at Rate tokens a second
+// up to Burst tokens.
+type RateLimiter struct {
+	Rate  float64
+	Burst float64
+
+	buckets map[string]*bucket
+	swept   time.Time
+	sync.Mutex
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of the client. If there is none, it
+// returns false and the time until there is one.
+func (rl *RateLimiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	// Forget the clients whose buckets have been refilled
+	full := time.Duration(rl.Burst / rl.Rate * float64(time.Second))
+	if now.Sub(rl.swept) > full && now.Sub(rl.swept) > time.Minute {
+		for c, b := range rl.buckets {
+			if now.Sub(b.updated) > full {
+				delete(rl.buckets, c)
+			}
+		}
+		rl.swept = now
+	}
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &bucket{tokens: rl.Burst, updated: now}
+		rl.buckets[client] = b
+	}
+	b.tokens = math.Min(rl.Burst, b.tokens+now.Sub(b.updated).Seconds()*rl.Rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Guard turns away the clients not allowed on the listener with 403, and
+// those over the rate limit with 429. Clients on Unix sockets have no
+// address, and are always let through.
+func (l *ListenerConfig) Guard(next http.Handler) http.Handler {
+	stats := statsFor(l.Name)
+	var limiter *RateLimiter
+	if l.RateLimit > 0 {
+		limiter = NewRateLimiter(l.RateLimit, l.RateBurst)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !l.Allowed(ip) {
+			atomic.AddUint64(&stats.Blocked, 1)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if limiter != nil {
+			if ok, wait := limiter.Allow(ip.String(), time.Now()); !ok {
+				atomic.AddUint64(&stats.Limited, 1)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessLogWriter records the status and size of the response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush is needed for streams
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// LogAccess logs every request as key=value pairs once it has been served.
+func (l *ListenerConfig) LogAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+
+		client := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			client = host
+		}
+		if client == "" || client == "@" {
+			client = "local"
+		}
+		log.Printf("access listener=%s client=%s method=%s route=%q status=%d bytes=%d duration=%.3fms\n",
+			l.Name, client, r.Method, r.URL.RequestURI(), aw.status, aw.bytes,
+			float64(time.Since(start))/float64(time.Millisecond))
+	})
+}
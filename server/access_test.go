@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected []string
+		err      bool
+	}{
+		{s: ""},
+		{s: " , "},
+		{s: "10.0.0.0/8", expected: []string{"10.0.0.0/8"}},
+		{s: "192.0.2.1, 2001:db8::1", expected: []string{"192.0.2.1/32", "2001:db8::1/128"}},
+		{s: "10.1.2.3/8,2001:db8::/32", expected: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{s: "10.0.0.0/33", err: true},
+		{s: "example.com", err: true},
+	}
+
+	for _, test := range tests {
+		networks, err := parseCIDRs(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.s, networks)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if len(networks) != len(test.expected) {
+			t.Errorf("%q: got %v, expected %v", test.s, networks, test.expected)
+			continue
+		}
+		for i, network := range networks {
+			if network.String() != test.expected[i] {
+				t.Errorf("%q: got %v, expected %v", test.s, networks, test.expected)
+			}
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	networks := func(s string) []*net.IPNet {
+		n, err := parseCIDRs(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name    string
+		allow   string
+		deny    string
+		ip      string
+		allowed bool
+	}{
+		{"no lists", "", "", "192.0.2.1", true},
+		{"allowed", "192.0.2.0/24", "", "192.0.2.1", true},
+		{"not allowed", "192.0.2.0/24", "", "198.51.100.1", false},
+		{"denied", "", "192.0.2.1", "192.0.2.1", false},
+		{"not denied", "", "192.0.2.1", "192.0.2.2", true},
+		{"deny overrides allow", "192.0.2.0/24", "192.0.2.1", "192.0.2.1", false},
+		{"allowed next to denied", "192.0.2.0/24", "192.0.2.1", "192.0.2.2", true},
+		{"IPv6", "2001:db8::/32", "", "2001:db8::1", true},
+		{"IPv4 mapped IPv6", "192.0.2.0/24", "", "::ffff:192.0.2.1", true},
+	}
+
+	for _, test := range tests {
+		l := &ListenerConfig{Allow: networks(test.allow), Deny: networks(test.deny)}
+		if got := l.Allowed(net.ParseIP(test.ip)); got != test.allowed {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.allowed)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1560944655, 0)
+	rl := NewRateLimiter(2, 3)
+
+	tests := []struct {
+		name   string
+		client string
+		at     time.Duration
+		ok     bool
+		wait   time.Duration
+	}{
+		{"burst 1", "a", 0, true, 0},
+		{"burst 2", "a", 0, true, 0},
+		{"burst 3", "a", 0, true, 0},
+		{"over the burst", "a", 0, false, 500 * time.Millisecond},
+		{"other client", "b", 0, true, 0},
+		{"partly refilled", "a", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"refilled", "a", 500 * time.Millisecond, true, 0},
+		{"empty again", "a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"full after a while", "a", 10 * time.Second, true, 0},
+		{"capped at the burst 1", "a", 10 * time.Second, true, 0},
+		{"capped at the burst 2", "a", 10 * time.Second, true, 0},
+		{"capped at the burst 3", "a", 10 * time.Second, false, 500 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		ok, wait := rl.Allow(test.client, start.Add(test.at))
+		if ok != test.ok || (wait-test.wait).Round(time.Millisecond) != 0 {
+			t.Errorf("%s: got %v and %v, expected %v and %v", test.name, ok, wait, test.ok, test.wait)
+		}
+	}
+
+	// The clients whose buckets are full again are forgotten, at most once a
+	// minute
+	rl.Allow("c", start.Add(2*time.Minute))
+	if _, ok := rl.buckets["a"]; ok {
+		t.Error("sweep: the full bucket of a was kept")
+	}
+	if _, ok := rl.buckets["c"]; !ok {
+		t.Error("sweep: the bucket of c was removed")
+	}
+	rl.Allow("d", start.Add(2*time.Minute+30*time.Second))
+	rl.Allow("e", start.Add(2*time.Minute+59*time.Second))
+	if _, ok := rl.buckets["d"]; !ok {
+		t.Error("sweep: swept again within a minute")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	deny, err := parseCIDRs("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &ListenerConfig{Name: "guard-test", Deny: deny, RateLimit: 0.4, RateBurst: 1}
+	h := l.Guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		code       int
+		retryAfter string
+	}{
+		{"denied", "192.0.2.1:1234", http.StatusForbidden, ""},
+		{"allowed", "192.0.2.2:1234", http.StatusOK, ""},
+		// 2.5s until the next token, rounded up
+		{"limited", "192.0.2.2:1235", http.StatusTooManyRequests, "3"},
+		{"Unix socket", "@", http.StatusOK, ""},
+		{"Unix socket again", "@", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.code || w.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("%s: got %d with Retry-After %q, expected %d with %q",
+				test.name, w.Code, w.Header().Get("Retry-After"), test.code, test.retryAfter)
+		}
+	}
+
+	stats := statsFor("guard-test")
+	if stats.Blocked != 1 || stats.Limited != 1 {
+		t.Errorf("got %d blocked and %d limited, expected 1 and 1", stats.Blocked, stats.Limited)
+	}
+}
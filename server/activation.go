@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first socket passed by systemd
+const listenFdsStart = 3
+
+// ActivatedSocket is a listening socket passed by systemd socket activation,
+// named by FileDescriptorName= in the socket unit.
+type ActivatedSocket struct {
+	Name     string
+	Listener net.Listener
+}
+
+var activated []ActivatedSocket
+
+// ActivateSockets takes the listening sockets passed by systemd, if any. The
+// environment variables are unset so that they are not passed on.
+func ActivateSockets() error {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		activated = append(activated, ActivatedSocket{Name: name, Listener: ln})
+	}
+	return nil
+}
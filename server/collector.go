@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	CollectorOK      = "ok"
+	CollectorUnknown = "unknown"
+)
+
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+)
+
+// CollectorStatus is the state of a collector, as published in the status.
+// The age is the number of seconds since the last good value.
+type CollectorStatus struct {
+	State     string `json:"state"`
+	Age       int    `json:"age"`
+	Errors    uint64 `json:"errors"`
+	LastError string `json:"last-error,omitempty"`
+}
+
+// Collector keeps track of the failures to read a metric. While failing, the
+// last good value of the metric is kept by the worker.
+type Collector struct {
+	Name      string
+	lastGood  time.Time
+	failing   bool
+	errors    uint64
+	lastError string
+}
+
+func NewCollector(name string) *Collector {
+	return &Collector{Name: name}
+}
+
+func (c *Collector) Success(now time.Time) {
+	if c.failing {
+		log.Println("Collector " + c.Name + " recovered")
+	}
+	c.failing = false
+	c.lastGood = now
+}
+
+func (c *Collector) Failure(err error) {
+	// Only log new errors, to not flood the log on every interval
+	if !c.failing || err.Error() != c.lastError {
+		log.Println("Collector "+c.Name+" failed:", err)
+	}
+	c.failing = true
+	c.errors++
+	c.lastError = err.Error()
+}
+
+// Failing returns true if the collector has no current value, either because
+// the last read failed or because there has not been a good read yet.
+func (c *Collector) Failing() bool {
+	return c.failing || c.lastGood.IsZero()
+}
+
+func (c *Collector) Status(now time.Time) *CollectorStatus {
+	s := &CollectorStatus{
+		State:     CollectorOK,
+		Errors:    c.errors,
+		LastError: c.lastError,
+	}
+	if c.Failing() {
+		s.State = CollectorUnknown
+	}
+	if !c.lastGood.IsZero() {
+		s.Age = int(now.Sub(c.lastGood).Seconds())
+	}
+	return s
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Each setting is also a command line flag.
+func init() {
+	flag.String("collector-failure", FailClosed, "Whether the node stays free on the last good values when a collector fails (open) or not (closed)")
+	flag.String("maintenance", "/etc/varnish/maintenance", "File in the file system indicating maintenance mode")
+	flag.String("maintenance-token", os.Getenv("MAINTENANCE_TOKEN"), "Bearer token for the maintenance endpoints. The default value is read from the environment variable MAINTENANCE_TOKEN.")
+	flag.String("node-id", "", "Identifier of the node, which the master compares to the name of the node in its configuration")
+	flag.String("listen-host", "127.0.0.1", "Listen host")
+	flag.Int("listen-port", 8080, "Listen port")
+	flag.String("net-threshold", "800 Mbps", "Network bandwidth threshold (units bps, Kbps, Mbps, Gbps and Tbps)")
+	flag.String("net-dev", "all", "Network interface to read stats from")
+	flag.Int("interval", 1, "Data gather interval in seconds")
+	flag.String("collectors", "net,load", "Comma separated list of collectors to enable (net and load)")
+	flag.Float64("load-threshold", 0, "Load average (1 minute) threshold, 0 to disable")
+	flag.String("net-curve", "linear", "Curve mapping network headroom to weight (linear, square and sqrt)")
+	flag.String("load-curve", "linear", "Curve mapping load headroom to weight (linear, square and sqrt)")
+	flag.Int("weight-floor", 0, "The node is free while the weight is above this value")
+	flag.Int("not-free-status", 200, "HTTP status code to respond with when the node is not free, 200, 429 or 503")
+	flag.Duration("drain", 0, "Period to ramp the weight down over when entering maintenance mode")
+	flag.Duration("slow-start", 0, "Period to ramp the weight up over when leaving maintenance mode")
+	flag.String("tls-cert", "", "TLS certificate file, reloaded when modified. TLS is enabled when set.")
+	flag.String("tls-key", "", "TLS key file, reloaded when modified")
+	flag.String("tls-client-ca", "", "CA bundle to verify client certificates against. Client certificates are required when set.")
+	flag.String("tls-client-allow", "", "Comma separated list of patterns, such as \"*.mgmt.example.com\", that the subject or a subject alternative name of client certificates must match")
+	flag.String("tls-maintenance-allow", "", "Comma separated list of patterns of client certificates allowed to use the maintenance endpoints")
+	flag.String("allow", "", "Comma separated list of networks, such as \"10.0.0.0/8\", allowed to connect. All are allowed when empty.")
+	flag.String("deny", "", "Comma separated list of networks denied to connect, overriding allow")
+	flag.Float64("rate-limit", 0, "Requests per second allowed per client address, 0 to disable")
+	flag.Int("rate-burst", 10, "Requests a client may make in a burst above the rate limit")
+	flag.Bool("access-log", false, "Log every request")
+	flag.String("signing-key", "", "Key file to sign the status with. Signing is enabled when set.")
+	flag.String("signing-algorithm", SignHMAC, "Signing algorithm, hmac-sha256 with a key shared with the master or ed25519 with a private key")
+	flag.String("status-file", "", "File to write the status to on every update, for local tools. Disabled when empty.")
+	flag.String("status-file-format", "json", "Format of the status file, json, text (key=value lines) or token (free or busy)")
+	flag.String("status-file-mode", "0644", "Permissions of the status file")
+	flag.String("status-file-group", "", "Group, by name or ID, to own the status file")
+	flag.Int("history-size", 3600, "Number of samples kept in the history, 0 to disable")
+	flag.Duration("shutdown-grace", 5*time.Second, "Period to advertise the node as not free before shutting down")
+}
+
+// Config is the effective configuration. Settings in the configuration file
+// have the same names as the command line flags, and flags given on the
+// command line override the file. Listeners are defined in sections of the
+// file, see ListenerConfig.
+type Config struct {
+	NodeID           string
+	Interval         int
+	NetDevice        string
+	NetThreshold     uint64
+	NetCurve         curve
+	LoadThreshold    float64
+	LoadCurve        curve
+	WeightFloor      int
+	NotFreeStatus    int
+	Collectors       map[string]bool
+	CollectorFailure string
+	Maintenance      string
+	MaintenanceToken string
+	Drain            time.Duration
+	SlowStart        time.Duration
+	ShutdownGrace    time.Duration
+	HistorySize      int
+	Listeners        []*ListenerConfig
+	Signer           *Signer
+	Labels           map[string]string
+	StatusFile       string
+	StatusFileFormat string
+	StatusFileMode   os.FileMode
+	StatusFileGroup  int
+}
+
+// Labels of the node, from the labels section
+const labelPrefix = "labels."
+
+// Settings that only take effect on restart, along with the listener sections
+var restartSettings = []string{"listen-host", "listen-port", "maintenance", "tls-cert", "tls-key", "tls-client-ca",
+	"allow", "deny", "rate-limit", "rate-burst", "access-log"}
+
+func restartSetting(name string) bool {
+	if strings.HasPrefix(name, listenerPrefix) {
+		return true
+	}
+	for _, setting := range restartSettings {
+		if name == setting {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	config       atomic.Value
+	configValues map[string]string
+	reloadLock   sync.Mutex
+)
+
+// Conf returns the current configuration.
+func Conf() *Config {
+	return config.Load().(*Config)
+}
+
+// LoadConfig reads the configuration file at path, if any, and merges it
+// with the command line flags.
+func LoadConfig(path string) (*Config, map[string]string, error) {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.DefValue
+	})
+
+	if path != "" {
+		file, err := ini.Load(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range file.Section("").Keys() {
+			if _, ok := values[key.Name()]; !ok || key.Name() == "config" {
+				return nil, nil, fmt.Errorf("unknown setting: %v", key.Name())
+			}
+			values[key.Name()] = key.Value()
+		}
+
+		// Labels and listener settings are kept as <section>.<key>
+		for _, section := range file.Sections() {
+			if section.Name() == ini.DefaultSection {
+				continue
+			}
+			if section.Name() == "labels" {
+				for _, key := range section.Keys() {
+					values[labelPrefix+key.Name()] = key.Value()
+				}
+				continue
+			}
+			if !strings.HasPrefix(section.Name(), listenerPrefix) {
+				return nil, nil, fmt.Errorf("unknown section: %v", section.Name())
+			}
+			for _, key := range section.Keys() {
+				if !listenerSettings[key.Name()] {
+					return nil, nil, fmt.Errorf("unknown setting in %v: %v", section.Name(), key.Name())
+				}
+				values[section.Name()+"."+key.Name()] = key.Value()
+			}
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+
+	c, err := parseConfig(values)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, values, nil
+}
+
+func parseConfig(values map[string]string) (*Config, error) {
+	var c Config
+	var err error
+
+	c.NodeID = values["node-id"]
+	c.NetDevice = values["net-dev"]
+	c.Maintenance = values["maintenance"]
+	c.MaintenanceToken = values["maintenance-token"]
+
+	if c.Interval, err = strconv.Atoi(values["interval"]); err != nil {
+		return nil, fmt.Errorf("unable to parse interval: %v", err)
+	}
+	if c.Interval < 1 {
+		return nil, errors.New("interval must be higher than 0")
+	}
+
+	if c.NetThreshold, err = ParseBit(values["net-threshold"]); err != nil {
+		return nil, fmt.Errorf("unable to parse network threshold: %v", err)
+	}
+	if c.NetThreshold == 0 {
+		return nil, errors.New("network threshold must be higher than 0")
+	}
+	if c.NetCurve, err = ParseCurve(values["net-curve"]); err != nil {
+		return nil, fmt.Errorf("unable to parse network curve: %v", err)
+	}
+
+	if c.LoadThreshold, err = strconv.ParseFloat(values["load-threshold"], 64); err != nil {
+		return nil, fmt.Errorf("unable to parse load threshold: %v", err)
+	}
+	if c.LoadThreshold < 0 {
+		return nil, errors.New("load threshold must not be negative")
+	}
+	if c.LoadCurve, err = ParseCurve(values["load-curve"]); err != nil {
+		return nil, fmt.Errorf("unable to parse load curve: %v", err)
+	}
+
+	if c.WeightFloor, err = strconv.Atoi(values["weight-floor"]); err != nil {
+		return nil, fmt.Errorf("unable to parse weight floor: %v", err)
+	}
+	if c.WeightFloor < 0 || c.WeightFloor > 99 {
+		return nil, errors.New("weight floor must be between 0 and 99")
+	}
+
+	if c.NotFreeStatus, err = strconv.Atoi(values["not-free-status"]); err != nil {
+		return nil, fmt.Errorf("unable to parse not free status: %v", err)
+	}
+	// The master only takes a status from these responses
+	if c.NotFreeStatus != http.StatusOK && c.NotFreeStatus != http.StatusTooManyRequests && c.NotFreeStatus != http.StatusServiceUnavailable {
+		return nil, errors.New("not free status must be 200, 429 or 503")
+	}
+
+	c.Collectors = make(map[string]bool)
+	for _, name := range strings.Split(values["collectors"], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name != "net" && name != "load" {
+			return nil, fmt.Errorf("unknown collector: %v", name)
+		}
+		c.Collectors[name] = true
+	}
+
+	c.CollectorFailure = values["collector-failure"]
+	if c.CollectorFailure != FailOpen && c.CollectorFailure != FailClosed {
+		return nil, fmt.Errorf("invalid collector failure policy: %v", c.CollectorFailure)
+	}
+
+	if c.Drain, err = time.ParseDuration(values["drain"]); err != nil {
+		return nil, fmt.Errorf("unable to parse drain: %v", err)
+	}
+	if c.SlowStart, err = time.ParseDuration(values["slow-start"]); err != nil {
+		return nil, fmt.Errorf("unable to parse slow start: %v", err)
+	}
+	if c.Drain < 0 || c.SlowStart < 0 {
+		return nil, errors.New("drain and slow start periods must not be negative")
+	}
+	if c.ShutdownGrace, err = time.ParseDuration(values["shutdown-grace"]); err != nil {
+		return nil, fmt.Errorf("unable to parse shutdown grace: %v", err)
+	}
+
+	if c.HistorySize, err = strconv.Atoi(values["history-size"]); err != nil {
+		return nil, fmt.Errorf("unable to parse history size: %v", err)
+	}
+	if c.HistorySize < 0 {
+		return nil, errors.New("history size must not be negative")
+	}
+
+	if c.Listeners, err = parseListeners(values); err != nil {
+		return nil, err
+	}
+
+	for key, value := range values {
+		if strings.HasPrefix(key, labelPrefix) {
+			if c.Labels == nil {
+				c.Labels = make(map[string]string)
+			}
+			c.Labels[strings.TrimPrefix(key, labelPrefix)] = value
+		}
+	}
+
+	c.StatusFile = values["status-file"]
+	c.StatusFileFormat = values["status-file-format"]
+	if !statusFileFormats[c.StatusFileFormat] {
+		return nil, fmt.Errorf("unknown status file format: %v", c.StatusFileFormat)
+	}
+	mode, err := strconv.ParseUint(values["status-file-mode"], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse status file mode: %v", err)
+	}
+	c.StatusFileMode = os.FileMode(mode) & os.ModePerm
+	if c.StatusFileGroup, err = lookupGroup(values["status-file-group"]); err != nil {
+		return nil, fmt.Errorf("unable to look up status file group: %v", err)
+	}
+
+	if values["signing-key"] != "" {
+		if c.Signer, err = LoadSigner(values["signing-algorithm"], values["signing-key"]); err != nil {
+			return nil, fmt.Errorf("unable to load signing key: %v", err)
+		}
+	}
+
+	return &c, nil
+}
+
+// parsePatterns parses a comma separated list of shell patterns.
+func parsePatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%v: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// ReloadConfig reloads the configuration file. An invalid configuration is
+// logged, and the current configuration is kept.
+func ReloadConfig(path string) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	c, values, err := LoadConfig(path)
+	if err != nil {
+		log.Println("Unable to reload configuration, keeping the current one:", err)
+		return
+	}
+
+	// Keep the current value of settings that need a restart
+	changed := false
+	for name := range union(values, configValues) {
+		if restartSetting(name) && values[name] != configValues[name] {
+			log.Printf("Setting %s changed, restart to apply it\n", name)
+			if value, ok := configValues[name]; ok {
+				values[name] = value
+			} else {
+				delete(values, name)
+			}
+			changed = true
+		}
+	}
+	if changed {
+		if c, err = parseConfig(values); err != nil {
+			log.Println("Unable to reload configuration, keeping the current one:", err)
+			return
+		}
+	}
+
+	for name, value := range values {
+		if value != configValues[name] && name != "maintenance-token" {
+			log.Printf("Setting %s changed to %q\n", name, value)
+		}
+	}
+	configValues = values
+	config.Store(c)
+	log.Println("Configuration reloaded")
+	Wake()
+}
+
+func union(a map[string]string, b map[string]string) map[string]bool {
+	keys := make(map[string]bool)
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+	return keys
+}
+
+// WatchConfig reloads the configuration file when it has been modified.
+func WatchConfig(path string) {
+	var modified time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modified = fi.ModTime()
+	}
+
+	for range time.Tick(time.Second) {
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Equal(modified) {
+			continue
+		}
+		modified = fi.ModTime()
+		ReloadConfig(path)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Format is an output format of the status.
+type Format struct {
+	ContentType string
+	Encode      func(s *Status) ([]byte, error)
+}
+
+var formats = map[string]Format{
+	// Indented JSON, as always served
+	"json": {"application/json", func(s *Status) ([]byte, error) {
+		return json.MarshalIndent(s, "", "    ")
+	}},
+	"compact": {"application/json", func(s *Status) ([]byte, error) {
+		return json.Marshal(s)
+	}},
+	// key=value lines, with nested keys joined by dots
+	"text": {"text/plain; charset=utf-8", encodeText},
+	// A single line starting with "free" or "busy", for VCL
+	"line": {"text/plain; charset=utf-8", encodeLine},
+	"msgpack": {"application/msgpack", func(s *Status) ([]byte, error) {
+		v, err := decodedStatus(s)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = EncodeMsgpack(&buf, v)
+		return buf.Bytes(), err
+	}},
+}
+
+// Media types of the Accept header mapped to formats
+var acceptTable = map[string]string{
+	"application/json":      "json",
+	"application/*":         "json",
+	"*/*":                   "json",
+	"text/plain":            "text",
+	"text/*":                "text",
+	"application/msgpack":   "msgpack",
+	"application/x-msgpack": "msgpack",
+}
+
+// Negotiate returns the format asked for with the format parameter or the
+// Accept header, or false if none of them are available.
+func Negotiate(r *http.Request) (string, bool) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		_, ok := formats[f]
+		return f, ok
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return "json", true
+	}
+
+	// Pick the most preferred media type that is available
+	format := ""
+	best := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			fmt.Sscanf(v, "%g", &q)
+		}
+		if f, ok := acceptTable[mediaType]; ok && q > best {
+			format = f
+			best = q
+		}
+	}
+	return format, format != ""
+}
+
+// decodedStatus returns the status as decoded JSON, for generic encoders.
+func decodedStatus(s *Status) (map[string]interface{}, error) {
+	out, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var v map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(out))
+	d.UseNumber()
+	err = d.Decode(&v)
+	return v, err
+}
+
+func encodeText(s *Status) ([]byte, error) {
+	v, err := decodedStatus(s)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	var flatten func(prefix string, v interface{})
+	flatten = func(prefix string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, e := range m {
+				flatten(prefix+k+".", e)
+			}
+			return
+		}
+		values[strings.TrimSuffix(prefix, ".")] = v
+	}
+	flatten("", v)
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := values[k]
+		if v == nil {
+			v = ""
+		}
+		lines = append(lines, k+"="+escapeNewlines.Replace(fmt.Sprint(v)))
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+func encodeLine(s *Status) ([]byte, error) {
+	state := "busy"
+	if s.Free {
+		state = "free"
+	}
+	return []byte(fmt.Sprintf("%s %d %s\n", state, s.Weight, escapeNewlines.Replace(s.Reason))), nil
+}
+
+// Reasons from the maintenance file may span lines, which would break the
+// line based formats
+var escapeNewlines = strings.NewReplacer("\r", `\r`, "\n", `\n`)
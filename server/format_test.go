@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeMultilineReason(t *testing.T) {
+	s := benchmarkStatus()
+	s.Free = false
+	s.Weight = 0
+	s.Reason = "Maintenance mode: Kernel upgrade\r\nthen reboot\n"
+
+	line, err := encodeLine(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `busy 0 Maintenance mode: Kernel upgrade\r\nthen reboot\n` + "\n"
+	if string(line) != expected {
+		t.Errorf("line: got %q, expected %q", line, expected)
+	}
+
+	text, err := encodeText(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `reason=Maintenance mode: Kernel upgrade\r\nthen reboot\n`
+	found := false
+	for _, l := range strings.Split(strings.TrimSuffix(string(text), "\n"), "\n") {
+		if !strings.Contains(l, "=") {
+			t.Errorf("text: line without =: %q", l)
+		}
+		if l == expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("text: no line %q in %q", expected, text)
+	}
+}
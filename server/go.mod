@@ -1,6 +1,6 @@
 module github.com/varnish/nodestatus
 
-go 1.12
+go 1.13
 
 require (
 	github.com/StackExchange/wmi v0.0.0-20190523213315-cbe66965904d // indirect
@@ -11,4 +11,5 @@ require (
 	github.com/shirou/w32 v0.0.0-20160930032740-bb4de0191aa4 // indirect
 	github.com/stretchr/testify v1.2.2 // indirect
 	golang.org/x/sys v0.0.0-20190618155005-516e3c20635f // indirect
+	gopkg.in/ini.v1 v1.55.0
 )
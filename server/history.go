@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics kept in the history, by name
+var historyMetrics = [...]string{"net-bps", "net-utilization", "net-weight", "load1", "load5", "load15", "load-weight"}
+
+// HistorySample is a status in the history. Transition is true when the free
+// state changed since the previous sample.
+type HistorySample struct {
+	Time       int64
+	Free       bool
+	Weight     int
+	Reason     string
+	Transition bool
+	Metrics    [len(historyMetrics)]float64
+}
+
+func NewHistorySample(s *Status) HistorySample {
+	return HistorySample{
+		Time:   s.Time,
+		Free:   s.Free,
+		Weight: s.Weight,
+		Reason: s.Reason,
+		Metrics: [len(historyMetrics)]float64{
+			float64(s.bps),
+			float64(s.NetUtilization),
+			float64(s.netWeight),
+			s.Load1,
+			s.Load5,
+			s.Load15,
+			float64(s.loadWeight),
+		},
+	}
+}
+
+// History is a ring buffer of the last samples.
+type History struct {
+	samples []HistorySample
+	next    int
+	count   int
+	sync.RWMutex
+}
+
+var history History
+
+// Add adds a sample, replacing the oldest one when full. The buffer is
+// resized if the configured size has changed.
+func (h *History) Add(sample HistorySample, size int) {
+	h.Lock()
+	defer h.Unlock()
+
+	if size != len(h.samples) {
+		samples := h.ordered()
+		if len(samples) > size {
+			samples = samples[len(samples)-size:]
+		}
+		h.samples = make([]HistorySample, size)
+		h.count = copy(h.samples, samples)
+		h.next = 0
+		if size > 0 {
+			h.next = h.count % size
+		}
+	}
+	if size == 0 {
+		return
+	}
+
+	if h.count > 0 {
+		prev := h.samples[(h.next+size-1)%size]
+		sample.Transition = prev.Free != sample.Free
+	}
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % size
+	if h.count < size {
+		h.count++
+	}
+}
+
+// ordered returns the samples from the oldest to the newest.
+func (h *History) ordered() []HistorySample {
+	samples := make([]HistorySample, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		samples = append(samples, h.samples[(h.next-h.count+i+len(h.samples))%len(h.samples)])
+	}
+	return samples
+}
+
+// Since returns the samples from the given unix time, oldest first.
+func (h *History) Since(since int64) []HistorySample {
+	h.RLock()
+	defer h.RUnlock()
+
+	samples := h.ordered()
+	for i, sample := range samples {
+		if sample.Time >= since {
+			return samples[i:]
+		}
+	}
+	return nil
+}
+
+// parseSince parses a unix time, or a duration back from now.
+func parseSince(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if since, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return since, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid since: %v", s)
+	}
+	return time.Now().Add(-d).Unix(), nil
+}
+
+// parseHistoryMetrics returns the indexes of the metrics asked for, or all of them.
+func parseHistoryMetrics(s string) ([]int, error) {
+	var indexes []int
+	if s == "" {
+		for i := range historyMetrics {
+			indexes = append(indexes, i)
+		}
+		return indexes, nil
+	}
+
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for i, metric := range historyMetrics {
+			if metric == strings.TrimSpace(name) {
+				indexes = append(indexes, i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown metric: %v", name)
+		}
+	}
+	return indexes, nil
+}
+
+type historyEntry struct {
+	Time       int64              `json:"time"`
+	Free       bool               `json:"free"`
+	Weight     int                `json:"weight"`
+	Reason     string             `json:"reason"`
+	Transition bool               `json:"transition,omitempty"`
+	Metrics    map[string]float64 `json:"metrics"`
+}
+
+// historyHandler serves the history as JSON, or as CSV with format=csv or
+// Accept: text/csv.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metrics, err := parseHistoryMetrics(r.URL.Query().Get("metrics"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	samples := history.Since(since)
+
+	if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Cache-Control", "no-store")
+		writeHistoryCSV(w, samples, metrics)
+		return
+	}
+
+	entries := make([]historyEntry, 0, len(samples))
+	for _, sample := range samples {
+		e := historyEntry{
+			Time:       sample.Time,
+			Free:       sample.Free,
+			Weight:     sample.Weight,
+			Reason:     sample.Reason,
+			Transition: sample.Transition,
+			Metrics:    make(map[string]float64),
+		}
+		for _, i := range metrics {
+			e.Metrics[historyMetrics[i]] = sample.Metrics[i]
+		}
+		entries = append(entries, e)
+	}
+	writeJSON(w, entries)
+}
+
+func writeHistoryCSV(w io.Writer, samples []HistorySample, metrics []int) {
+	c := csv.NewWriter(w)
+	header := []string{"time", "free", "weight", "reason", "transition"}
+	for _, i := range metrics {
+		header = append(header, historyMetrics[i])
+	}
+	c.Write(header)
+
+	for _, sample := range samples {
+		record := []string{
+			strconv.FormatInt(sample.Time, 10),
+			strconv.FormatBool(sample.Free),
+			strconv.Itoa(sample.Weight),
+			sample.Reason,
+			strconv.FormatBool(sample.Transition),
+		}
+		for _, i := range metrics {
+			record = append(record, strconv.FormatFloat(sample.Metrics[i], 'f', -1, 64))
+		}
+		c.Write(record)
+	}
+	c.Flush()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// historyTimes returns the times of the samples, and the times of those
+// marked as a transition.
+func historyTimes(samples []HistorySample) ([]int64, []int64) {
+	var times, transitions []int64
+	for _, sample := range samples {
+		times = append(times, sample.Time)
+		if sample.Transition {
+			transitions = append(transitions, sample.Time)
+		}
+	}
+	return times, transitions
+}
+
+func TestHistory(t *testing.T) {
+	var h History
+	add := func(time int64, free bool, size int) {
+		h.Add(HistorySample{Time: time, Free: free}, size)
+	}
+
+	// Wrapping around, keeping the last samples
+	for i := int64(1); i <= 5; i++ {
+		add(i, i < 4, 3)
+	}
+	times, transitions := historyTimes(h.Since(0))
+	if !reflect.DeepEqual(times, []int64{3, 4, 5}) {
+		t.Errorf("wrapped: got %v", times)
+	}
+	if !reflect.DeepEqual(transitions, []int64{4}) {
+		t.Errorf("wrapped: got transitions %v", transitions)
+	}
+
+	// Since the given time, or nothing after the last sample
+	if times, _ := historyTimes(h.Since(4)); !reflect.DeepEqual(times, []int64{4, 5}) {
+		t.Errorf("since 4: got %v", times)
+	}
+	if samples := h.Since(6); len(samples) != 0 {
+		t.Errorf("since 6: got %v", samples)
+	}
+
+	// Growing keeps the samples, and wraps at the new size
+	for i := int64(6); i <= 8; i++ {
+		add(i, false, 5)
+	}
+	if times, _ := historyTimes(h.Since(0)); !reflect.DeepEqual(times, []int64{4, 5, 6, 7, 8}) {
+		t.Errorf("grown: got %v", times)
+	}
+	add(9, false, 5)
+	if times, _ := historyTimes(h.Since(0)); !reflect.DeepEqual(times, []int64{5, 6, 7, 8, 9}) {
+		t.Errorf("grown and wrapped: got %v", times)
+	}
+
+	// Shrinking keeps the newest samples
+	add(10, true, 2)
+	times, transitions = historyTimes(h.Since(0))
+	if !reflect.DeepEqual(times, []int64{9, 10}) {
+		t.Errorf("shrunk: got %v", times)
+	}
+	if !reflect.DeepEqual(transitions, []int64{10}) {
+		t.Errorf("shrunk: got transitions %v", transitions)
+	}
+
+	// A size of 0 disables the history
+	add(11, true, 0)
+	if samples := h.Since(0); len(samples) != 0 {
+		t.Errorf("disabled: got %v", samples)
+	}
+	add(12, true, 2)
+	if times, transitions := historyTimes(h.Since(0)); !reflect.DeepEqual(times, []int64{12}) || len(transitions) != 0 {
+		t.Errorf("enabled again: got %v, transitions %v", times, transitions)
+	}
+}
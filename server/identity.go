@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// Identity of the current boot, changed on every reboot
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// Identity of the installation, see machine-id(5)
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// readID returns the content of the first of the files that can be read, or
+// an empty string, as on systems without them.
+func readID(paths ...string) string {
+	for _, path := range paths {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Listener sections are named listener.<name>
+const listenerPrefix = "listener."
+
+// Settings of the listener sections
+var listenerSettings = map[string]bool{
+	"address":               true,
+	"socket-mode":           true,
+	"endpoints":             true,
+	"tls-cert":              true,
+	"tls-key":               true,
+	"tls-client-ca":         true,
+	"tls-client-allow":      true,
+	"tls-maintenance-allow": true,
+	"allow":                 true,
+	"deny":                  true,
+	"rate-limit":            true,
+	"rate-burst":            true,
+	"access-log":            true,
+}
+
+// Routes of each group of endpoints
+var endpoints = map[string][]string{
+	"status":      {"/", "/status", "/status/"},
+	"v2":          {"/v2/status", "/v2/schema.json"},
+	"metrics":     {"/metrics"},
+	"stream":      {"/stream"},
+	"history":     {"/history"},
+	"probes":      {"/live", "/ready"},
+	"maintenance": {"/maintenance", "/maintenance/history"},
+}
+
+// ListenerConfig is a listener, which serves the given endpoints at a TCP
+// address (host:port), a Unix socket (unix:/path) or sockets passed by
+// systemd (systemd:name, or systemd: for all of them).
+type ListenerConfig struct {
+	Name       string
+	Address    string
+	SocketMode os.FileMode
+	Endpoints  map[string]bool
+
+	TLSCert             string
+	TLSKey              string
+	TLSClientCA         string
+	TLSClientAllow      []string
+	TLSMaintenanceAllow []string
+
+	Allow     []*net.IPNet
+	Deny      []*net.IPNet
+	RateLimit float64
+	RateBurst int
+	AccessLog bool
+}
+
+// Listener returns the listener with the given name, or nil.
+func (c *Config) Listener(name string) *ListenerConfig {
+	for _, l := range c.Listeners {
+		if l.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// parseListeners parses the listener sections. Without any, there is a
+// single listener named default, from the listen and TLS settings, or on the
+// sockets passed by systemd if any.
+func parseListeners(values map[string]string) ([]*ListenerConfig, error) {
+	sections := make(map[string]map[string]string)
+	for key, value := range values {
+		if !strings.HasPrefix(key, listenerPrefix) {
+			continue
+		}
+		i := strings.LastIndex(key, ".")
+		name := key[len(listenerPrefix):i]
+		if sections[name] == nil {
+			sections[name] = make(map[string]string)
+		}
+		sections[name][key[i+1:]] = value
+	}
+
+	if len(sections) == 0 {
+		address := net.JoinHostPort(values["listen-host"], values["listen-port"])
+		if _, err := strconv.Atoi(values["listen-port"]); err != nil {
+			return nil, fmt.Errorf("unable to parse listen port: %v", err)
+		}
+		if len(activated) > 0 {
+			address = "systemd:"
+		}
+		sections["default"] = map[string]string{
+			"address":               address,
+			"tls-cert":              values["tls-cert"],
+			"tls-key":               values["tls-key"],
+			"tls-client-ca":         values["tls-client-ca"],
+			"tls-client-allow":      values["tls-client-allow"],
+			"tls-maintenance-allow": values["tls-maintenance-allow"],
+			"allow":                 values["allow"],
+			"deny":                  values["deny"],
+			"rate-limit":            values["rate-limit"],
+			"rate-burst":            values["rate-burst"],
+			"access-log":            values["access-log"],
+		}
+	}
+
+	var names []string
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var listeners []*ListenerConfig
+	for _, name := range names {
+		l, err := parseListener(name, sections[name])
+		if err != nil {
+			return nil, fmt.Errorf("listener %v: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func parseListener(name string, values map[string]string) (*ListenerConfig, error) {
+	var err error
+	l := &ListenerConfig{
+		Name:        name,
+		Address:     values["address"],
+		SocketMode:  0660,
+		Endpoints:   make(map[string]bool),
+		TLSCert:     values["tls-cert"],
+		TLSKey:      values["tls-key"],
+		TLSClientCA: values["tls-client-ca"],
+	}
+	if l.Address == "" {
+		return nil, errors.New("address must be set")
+	}
+
+	if values["socket-mode"] != "" {
+		mode, err := strconv.ParseUint(values["socket-mode"], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse socket mode: %v", err)
+		}
+		l.SocketMode = os.FileMode(mode) & os.ModePerm
+	}
+
+	if values["endpoints"] == "" || values["endpoints"] == "all" {
+		for group := range endpoints {
+			l.Endpoints[group] = true
+		}
+	} else {
+		for _, group := range strings.Split(values["endpoints"], ",") {
+			group = strings.TrimSpace(group)
+			if _, ok := endpoints[group]; !ok {
+				return nil, fmt.Errorf("unknown endpoints: %v", group)
+			}
+			l.Endpoints[group] = true
+		}
+	}
+
+	if (l.TLSCert == "") != (l.TLSKey == "") {
+		return nil, errors.New("both the TLS certificate and key must be set")
+	}
+	if l.TLSClientCA != "" && l.TLSCert == "" {
+		return nil, errors.New("the TLS client CA requires a TLS certificate")
+	}
+	if l.TLSClientAllow, err = parsePatterns(values["tls-client-allow"]); err != nil {
+		return nil, fmt.Errorf("unable to parse TLS client allow: %v", err)
+	}
+	if l.TLSMaintenanceAllow, err = parsePatterns(values["tls-maintenance-allow"]); err != nil {
+		return nil, fmt.Errorf("unable to parse TLS maintenance allow: %v", err)
+	}
+
+	if l.Allow, err = parseCIDRs(values["allow"]); err != nil {
+		return nil, fmt.Errorf("unable to parse allow: %v", err)
+	}
+	if l.Deny, err = parseCIDRs(values["deny"]); err != nil {
+		return nil, fmt.Errorf("unable to parse deny: %v", err)
+	}
+	if values["rate-limit"] != "" {
+		if l.RateLimit, err = strconv.ParseFloat(values["rate-limit"], 64); err != nil {
+			return nil, fmt.Errorf("unable to parse rate limit: %v", err)
+		}
+	}
+	if l.RateLimit < 0 {
+		return nil, errors.New("rate limit must not be negative")
+	}
+	l.RateBurst = 10
+	if values["rate-burst"] != "" {
+		if l.RateBurst, err = strconv.Atoi(values["rate-burst"]); err != nil {
+			return nil, fmt.Errorf("unable to parse rate burst: %v", err)
+		}
+	}
+	if l.RateBurst < 1 {
+		return nil, errors.New("rate burst must be at least 1")
+	}
+	if values["access-log"] != "" {
+		if l.AccessLog, err = strconv.ParseBool(values["access-log"]); err != nil {
+			return nil, fmt.Errorf("unable to parse access log: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// Listen opens the sockets of the listener.
+func (l *ListenerConfig) Listen() ([]net.Listener, error) {
+	switch {
+	case strings.HasPrefix(l.Address, "systemd:"):
+		name := strings.TrimPrefix(l.Address, "systemd:")
+		var listeners []net.Listener
+		for _, a := range activated {
+			if name == "" || a.Name == name {
+				listeners = append(listeners, a.Listener)
+			}
+		}
+		if len(listeners) == 0 {
+			return nil, errors.New("no sockets passed by systemd for " + l.Address)
+		}
+		return listeners, nil
+
+	case strings.HasPrefix(l.Address, "unix:"):
+		path := strings.TrimPrefix(l.Address, "unix:")
+		// Remove the socket left behind by a previous run
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, l.SocketMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+
+	default:
+		// An unspecified host, such as [::], listens on both IPv4 and IPv6
+		ln, err := net.Listen("tcp", l.Address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+}
+
+// Handler returns the handler of the endpoints enabled on the listener,
+// behind its access rules.
+func (l *ListenerConfig) Handler(handlers map[string]http.HandlerFunc) http.Handler {
+	mux := http.NewServeMux()
+	for group, routes := range endpoints {
+		if !l.Endpoints[group] {
+			continue
+		}
+		for _, route := range routes {
+			mux.HandleFunc(route, handlers[route])
+		}
+	}
+
+	var h http.Handler = l.Guard(mux)
+	if l.AccessLog {
+		h = l.LogAccess(h)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenerKey{}, l.Name)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type listenerKey struct{}
+
+// requestListener returns the current configuration of the listener the
+// request came in on.
+func requestListener(r *http.Request) *ListenerConfig {
+	name, _ := r.Context().Value(listenerKey{}).(string)
+	return Conf().Listener(name)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"compress/gzip"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -11,7 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/load"
@@ -19,158 +18,423 @@ import (
 )
 
 type Status struct {
-	Free           bool    `json:"free"`
-	Reason         string  `json:"reason"`
-	Load1          float64 `json:"load1"`
-	Load5          float64 `json:"load5"`
-	Load15         float64 `json:"load15"`
-	Net            string  `json:"net"`
-	NetThreshold   string  `json:"net-threshold"`
-	NetUtilization uint64  `json:"net-utilization"`
-	Time           int64   `json:"time"`
-	Uptime         int     `json:"uptime"`
-	Hostname       string  `json:"hostname"`
-	sync.RWMutex
+	Free           bool                        `json:"free"`
+	Reason         string                      `json:"reason"`
+	Load1          float64                     `json:"load1"`
+	Load5          float64                     `json:"load5"`
+	Load15         float64                     `json:"load15"`
+	Net            string                      `json:"net"`
+	NetThreshold   string                      `json:"net-threshold"`
+	NetUtilization uint64                      `json:"net-utilization"`
+	Weight         int                         `json:"weight"`
+	Ramp           *Ramp                       `json:"ramp,omitempty"`
+	Maintenance    *Maintenance                `json:"maintenance,omitempty"`
+	Time           int64                       `json:"time"`
+	Uptime         int                         `json:"uptime"`
+	Hostname       string                      `json:"hostname"`
+	NodeID         string                      `json:"node-id,omitempty"`
+	BootID         string                      `json:"boot-id,omitempty"`
+	MachineID      string                      `json:"machine-id,omitempty"`
+	Version        string                      `json:"version"`
+	StartTime      int64                       `json:"start-time"`
+	Labels         map[string]string           `json:"labels,omitempty"`
+	Collectors     map[string]*CollectorStatus `json:"collectors"`
+	updated        time.Time
+
+	// Kind of reason, one of reasonCodes
+	reasonCode string
+
+	// Raw values for the v2 schema
+	netDevice     string
+	bps           uint64
+	netThreshold  uint64
+	netWeight     int
+	loadThreshold float64
+	loadWeight    int
 }
 
+// The status is stale when it has not been updated for this many intervals,
+// for example if the worker is stuck reading a metric.
+const staleIntervals = 3
+
 var (
-	maintenanceFilePathFlag = flag.String("maintenance", "/etc/varnish/maintenance", "File in the file system indicating maintenance mode")
-	listenHostFlag          = flag.String("listen-host", "127.0.0.1", "Listen host")
-	listenPortFlag          = flag.Int("listen-port", 8080, "Listen port")
-	netThresholdFlag        = flag.String("net-threshold", "800 Mbps", "Network bandwidth threshold (units bps, Kbps, Mbps, Gbps and Tbps)")
-	netDeviceFlag           = flag.String("net-dev", "all", "Network interface to read stats from")
-	intervalFlag            = flag.Int("interval", 1, "Data gather interval in seconds")
-	status                  Status
-	netThreshold            uint64
+	configFilePathFlag = flag.String("config", "", "Configuration file, with settings named as the command line flags")
+	wake               = make(chan struct{}, 1)
+	shuttingDown       int32
 )
 
 func main() {
-	var err error
 	flag.Parse()
 
-	// Validate command line flags
-	if *intervalFlag < 1 {
-		log.Fatalln("Interval must be higher than 0")
+	// Take the sockets passed by systemd before the listeners are configured
+	if err := ActivateSockets(); err != nil {
+		log.Fatalln("Unable to use the sockets passed by systemd:", err)
 	}
 
-	netThreshold, err = ParseBit(*netThresholdFlag)
+	c, values, err := LoadConfig(*configFilePathFlag)
 	if err != nil {
-		log.Fatalln("Unable to parse network threshold:", err)
+		log.Fatalln("Unable to load configuration:", err)
+	}
+	config.Store(c)
+	configValues = values
+	log.Println("Network threshold set to " + HumanizeBit(c.NetThreshold))
+
+	if *configFilePathFlag != "" {
+		go WatchConfig(*configFilePathFlag)
+	}
+
+	// Watch the maintenance file to notice changes before the next interval
+	if err := WatchMaintenance(c.Maintenance); err != nil {
+		log.Println("Unable to watch maintenance file, polling on the interval only:", err)
 	}
-	log.Println("Network threshold set to " + HumanizeBit(netThreshold))
 
 	// Goroutine to collect metrics and calculate utilization
-	go status.Worker(*netDeviceFlag, *intervalFlag)
+	Publish(Status{Reason: "Initializing"})
+	go Worker()
+
+	// The catch-all route is kept for existing clients
+	handlers := map[string]http.HandlerFunc{
+		"/":                    statusHandler,
+		"/status":              statusHandler,
+		"/status/":             collectorHandler,
+		"/v2/status":           statusV2Handler,
+		"/v2/schema.json":      schemaV2Handler,
+		"/metrics":             metricsHandler,
+		"/stream":              streamHandler,
+		"/history":             gzipHandler(historyHandler),
+		"/live":                liveHandler,
+		"/ready":               readyHandler,
+		"/maintenance":         maintenanceHandler,
+		"/maintenance/history": gzipHandler(maintenanceHistoryHandler),
+	}
+	servers, err := Serve(c.Listeners, handlers)
+	if err != nil {
+		log.Fatalln("Unable to listen:", err)
+	}
+
+	// Tell systemd that the service is up, and keep its watchdog happy while
+	// the status is fresh
+	if err := SdNotify("READY=1"); err != nil {
+		log.Println("Unable to notify systemd:", err)
+	}
+	go Watchdog()
 
-	http.HandleFunc("/", gzipHandler(statusHandler))
+	// Block here until shut down
+	HandleSignals(servers)
+}
 
-	log.Println("Listening at " + *listenHostFlag + ":" + strconv.Itoa(*listenPortFlag))
-	log.Fatal(http.ListenAndServe(*listenHostFlag+":"+strconv.Itoa(*listenPortFlag), nil))
+// Stale returns true if the status has not been updated recently.
+func (s *Status) Stale() bool {
+	interval := time.Duration(Conf().Interval) * time.Second
+	return time.Since(s.updated) > staleIntervals*interval
 }
 
-func (s *Status) Worker(iface string, interval int) {
+func Worker() {
+	var s Status
 	var prevBytesSent uint64
 	var prevBytesRecv uint64
 	var bps uint64
+	var l load.AvgStat
+	var hostname string
 	startTime := time.Now()
-
-	var pernic bool
-	var maintenance bool
-
-	if iface == "all" {
-		pernic = false
-	} else {
-		pernic = true
+	bootID := readID(bootIDPath)
+	machineID := readID(machineIDPaths...)
+	c := Conf()
+	iface := c.NetDevice
+	interval := c.Interval
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	collect := true
+
+	var maintenanceErr string
+	var statusFileErr string
+	var historyFree bool
+	var expired bool
+	var ramper Ramper
+
+	// The last good values are kept when collectors fail
+	collectors := map[string]*Collector{
+		"net":      NewCollector("net"),
+		"load":     NewCollector("load"),
+		"hostname": NewCollector("hostname"),
 	}
 
 	for {
-		// Network
-		nics, err := net.IOCounters(pernic)
-		if err != nil {
-			log.Fatalln("Unable to read network stats:", err)
+		c = Conf()
+
+		// Pick up a reloaded interval or network interface, and start over
+		// measuring the bandwidth.
+		if c.Interval != interval {
+			interval = c.Interval
+			ticker.Stop()
+			ticker = time.NewTicker(time.Duration(interval) * time.Second)
+			prevBytesSent, prevBytesRecv, bps = 0, 0, 0
+		}
+		if c.NetDevice != iface {
+			iface = c.NetDevice
+			prevBytesSent, prevBytesRecv, bps = 0, 0, 0
 		}
 
-		var netBpsTx uint64
-		var netBpsRx uint64
-		for _, nic := range nics {
-			if iface == nic.Name {
-				if prevBytesSent > 0 {
-					netBpsTx = (nic.BytesSent - prevBytesSent) / uint64(interval) * 8
-				}
-				if prevBytesSent > 0 {
-					netBpsRx = (nic.BytesRecv - prevBytesRecv) / uint64(interval) * 8
-				}
-				prevBytesSent = nic.BytesSent
-				prevBytesRecv = nic.BytesRecv
-
-				// If the receive bandwidth is higher than transmit bandwidth,
-				// report receive bandwidth instead.
-				if netBpsTx > netBpsRx {
-					bps = netBpsTx
-				} else {
-					bps = netBpsRx
-				}
+		// Metrics are only collected on the interval, not when woken up to
+		// update the status.
+		if collect && c.Collectors["net"] {
+			// Network
+			if err := readNet(iface, interval, &prevBytesSent, &prevBytesRecv, &bps); err != nil {
+				collectors["net"].Failure(err)
+			} else {
+				collectors["net"].Success(time.Now())
 			}
 		}
+		if !c.Collectors["net"] {
+			prevBytesSent, prevBytesRecv, bps = 0, 0, 0
+		}
 
-		// Load
-		l, err := load.Avg()
-		if err != nil {
-			log.Fatalln("Unable to read load average:", err)
+		if collect && c.Collectors["load"] {
+			// Load
+			if avg, err := load.Avg(); err != nil {
+				collectors["load"].Failure(err)
+			} else {
+				l = *avg
+				collectors["load"].Success(time.Now())
+			}
+		}
+		if !c.Collectors["load"] {
+			l = load.AvgStat{}
 		}
 
-		// Hostname
-		hostname, err := os.Hostname()
-		if err != nil {
-			log.Fatalln("Unable to read hostname:", err)
+		if collect {
+			// Hostname
+			if h, err := os.Hostname(); err != nil {
+				collectors["hostname"].Failure(err)
+			} else {
+				hostname = h
+				collectors["hostname"].Success(time.Now())
+			}
 		}
 
 		// Time
 		now := time.Now()
 
 		// Maintenance mode
-		// If the file exists: Maintenance mode
+		// If the file exists: Maintenance mode, unless it has expired
 		// If the file does not exist: Not maintenance mode
-		if _, err := os.Stat(*maintenanceFilePathFlag); err == nil {
-			maintenance = true
+		// An expired file is removed, so that tools testing for it agree
+		m, err := ReadMaintenance(c.Maintenance)
+		if err != nil && err.Error() != maintenanceErr {
+			log.Println("Unable to read maintenance file:", err)
+		}
+		maintenanceErr = ""
+		if err != nil {
+			maintenanceErr = err.Error()
+			m.Reason += ": " + maintenanceErr
+		}
+		if m != nil && m.Expired(now) {
+			if !expired {
+				log.Println("Maintenance expired at " + time.Unix(m.Until, 0).Format(time.RFC3339))
+				if err := RemoveMaintenance(c.Maintenance); err != nil {
+					log.Println("Unable to remove expired maintenance file:", err)
+				}
+			}
+			expired = true
+			m = nil
 		} else {
-			maintenance = false
+			expired = false
 		}
+		maintenance := m != nil
 
-		s.Lock()
+		s.updated = now
 		s.Time = now.Unix()
 
 		// Uptime of this process
 		s.Uptime = int(now.Sub(startTime).Seconds())
 
+		// Identity of the node, to tell the wrong node, a reboot or a restart
+		s.NodeID = c.NodeID
+		s.BootID = bootID
+		s.MachineID = machineID
+		s.Version = version
+		s.StartTime = startTime.Unix()
+		s.Labels = c.Labels
+
 		s.Load1 = l.Load1
 		s.Load5 = l.Load5
 		s.Load15 = l.Load15
 		s.Hostname = hostname
 
+		s.Collectors = map[string]*CollectorStatus{
+			"hostname": collectors["hostname"].Status(now),
+		}
+		for name := range c.Collectors {
+			s.Collectors[name] = collectors[name].Status(now)
+		}
+
+		s.netDevice = iface
+		s.bps = bps
+		s.netThreshold = c.NetThreshold
+		s.loadThreshold = c.LoadThreshold
 		s.Net = HumanizeBit(bps)
-		s.NetThreshold = HumanizeBit(netThreshold)
-		s.NetUtilization = 100 * bps / netThreshold
+		s.NetThreshold = HumanizeBit(c.NetThreshold)
+		s.NetUtilization = 100 * bps / c.NetThreshold
+
+		// The weight is the score of the metric with the least headroom
+		netWeight := Weight(c.NetCurve(Headroom(float64(bps), float64(c.NetThreshold))))
+		loadWeight := Weight(c.LoadCurve(Headroom(l.Load1, c.LoadThreshold)))
+		s.netWeight = netWeight
+		s.loadWeight = loadWeight
+		s.Weight = netWeight
+		if loadWeight < s.Weight {
+			s.Weight = loadWeight
+		}
 
 		// Assume normal operation before checking readings
 		s.Free = true
 		s.Reason = "Normal operation"
+		s.reasonCode = "normal"
+
+		// Set free to false if the weight does not exceed the floor
+		if s.Weight <= c.WeightFloor {
+			s.Free = false
+			if netWeight <= loadWeight {
+				s.Reason = "Network fully utilizied"
+				s.reasonCode = "network"
+			} else {
+				s.Reason = "Load too high"
+				s.reasonCode = "load"
+			}
+		}
+
+		// Set free to false and drop the weight if a metric is unknown, unless
+		// failing open on the last good values
+		if c.CollectorFailure == FailClosed {
+			for _, name := range []string{"net", "load"} {
+				if c.Collectors[name] && collectors[name].Failing() {
+					s.Free = false
+					s.Weight = 0
+					s.Reason = "Unable to collect " + name
+					s.reasonCode = "collector"
+				}
+			}
+		}
+
+		// Scale the weight while draining or slow starting. The node stays
+		// free until a drain has completed.
+		hard := maintenance && m.Mode == MaintenanceHard
+		ramper.Drain = c.Drain
+		ramper.SlowStart = c.SlowStart
+		factor, ramp := ramper.Update(maintenance, hard, now)
+		s.Ramp = ramp
+		s.Maintenance = m
+		if ramp != nil {
+			s.Weight = Weight(float64(s.Weight) * factor)
+			if s.Free && ramp.Mode == RampDrain {
+				s.Reason = maintenanceReason("Draining for maintenance", m)
+				s.reasonCode = "draining"
+			}
+			if s.Free && ramp.Mode == RampSlowStart {
+				s.Reason = "Slow start after maintenance"
+				s.reasonCode = "slow_start"
+			}
+		}
 
-		// Set free to false if network is is utilized
-		if bps >= netThreshold {
+		// Set free to false and drop the weight if in maintenance mode
+		if maintenance && ramp == nil {
 			s.Free = false
-			s.Reason = "Network fully utilizied"
+			s.Weight = 0
+			s.Reason = maintenanceReason("Maintenance mode", m)
+			s.reasonCode = "maintenance"
 		}
 
-		// Set free to false if in maintenance mode
-		if maintenance {
+		// Set free to false and drop the weight if shutting down
+		if atomic.LoadInt32(&shuttingDown) == 1 {
 			s.Free = false
-			s.Reason = "Maintenance mode"
+			s.Weight = 0
+			s.Ramp = nil
+			s.Reason = "Shutting down"
+			s.reasonCode = "shutting_down"
+		}
+		if err := Publish(s); err != nil {
+			log.Println("Unable to publish status:", err)
+		}
+
+		// The history has a sample per interval, and one more when a wake up
+		// changes the free state, so that the transition is marked
+		if collect || s.Free != historyFree {
+			history.Add(NewHistorySample(&s), c.HistorySize)
+			historyFree = s.Free
 		}
-		s.Unlock()
 
-		time.Sleep(time.Duration(interval) * time.Second)
+		// Write the status file, logging only new errors
+		if c.StatusFile != "" {
+			err := WriteStatusFile(c, CurrentSnapshot())
+			if err != nil && err.Error() != statusFileErr {
+				log.Println("Unable to write status file:", err)
+			}
+			statusFileErr = ""
+			if err != nil {
+				statusFileErr = err.Error()
+			}
+		}
+
+		select {
+		case <-ticker.C:
+			collect = true
+		case <-wake:
+			collect = false
+		}
+	}
+}
+
+// Wake the worker to update the status without waiting for the interval.
+func Wake() {
+	// Never block, a pending wake up covers any number of changes
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// readNet updates the bandwidth from the network counters of iface. After a
+// failure, measuring starts over and the previous bandwidth is kept until
+// then.
+func readNet(iface string, interval int, prevBytesSent *uint64, prevBytesRecv *uint64, bps *uint64) error {
+	nics, err := net.IOCounters(iface != "all")
+	if err != nil {
+		*prevBytesSent = 0
+		*prevBytesRecv = 0
+		return err
+	}
+
+	for _, nic := range nics {
+		if iface != nic.Name {
+			continue
+		}
+
+		if *prevBytesSent > 0 {
+			netBpsTx := (nic.BytesSent - *prevBytesSent) / uint64(interval) * 8
+			netBpsRx := (nic.BytesRecv - *prevBytesRecv) / uint64(interval) * 8
+
+			// If the receive bandwidth is higher than transmit bandwidth,
+			// report receive bandwidth instead.
+			if netBpsTx > netBpsRx {
+				*bps = netBpsTx
+			} else {
+				*bps = netBpsRx
+			}
+		}
+		*prevBytesSent = nic.BytesSent
+		*prevBytesRecv = nic.BytesRecv
+		return nil
+	}
+
+	*prevBytesSent = 0
+	*prevBytesRecv = 0
+	return fmt.Errorf("no such network interface: %v", iface)
+}
+
+func maintenanceReason(prefix string, m *Maintenance) string {
+	if m.Reason == "" {
+		return prefix
 	}
+	return prefix + ": " + m.Reason
 }
 
 type gzipResponseWriter struct {
@@ -197,14 +461,110 @@ func gzipHandler(fn http.HandlerFunc) http.HandlerFunc {
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	format, ok := Negotiate(r)
+	if !ok {
+		http.Error(w, "Not Acceptable", http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", formats[format].ContentType)
 	w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=1")
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+
+	snap, err := waitSnapshot(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("X-Node-Generation", strconv.FormatUint(snap.Generation, 10))
+	if snap.Status.Stale() {
+		staleHandler(w, r, snap.Status, format)
+		return
+	}
 
-	status.Lock()
-	if out, err := json.MarshalIndent(status, "", "    "); err != nil {
+	// The representation differs per format and encoding, and so does the ETag
+	gzipped := format == "json" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	etag := snap.ETag(format, gzipped)
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		// Signed over the ETag, so that an unsigned 304 can not keep the
+		// master on an old status
+		signBody(w, []byte(etag))
+		writeStatusHeader(w, snap.Status, http.StatusNotModified)
+		return
+	}
+
+	body, err := snap.Encoded(format)
+	if err != nil {
 		http.Error(w, "Internal Server Error", 503)
-	} else {
-		fmt.Fprintf(w, string(out))
+		return
+	}
+	signBody(w, body)
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+		body = snap.Gzip
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writeStatusHeader(w, snap.Status, statusCode(snap.Status))
+
+	// HEAD is for cheap probes, which only need the headers
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// statusCode returns the configured status code for a node that is not free.
+func statusCode(s Status) int {
+	if s.Free {
+		return http.StatusOK
+	}
+	return Conf().NotFreeStatus
+}
+
+// writeStatusHeader writes the state of the node as headers, for probes that
+// do not parse the body.
+func writeStatusHeader(w http.ResponseWriter, s Status, code int) {
+	w.Header().Set("X-Node-Free", strconv.FormatBool(s.Free))
+	w.Header().Set("X-Node-Weight", strconv.Itoa(s.Weight))
+	w.Header().Set("X-Node-Reason", s.Reason)
+	w.WriteHeader(code)
+}
+
+// etagMatch returns true if the If-None-Match header matches etag. Weak
+// comparison is used, as for any If-None-Match.
+func etagMatch(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// staleStatus returns the status to advertise when the worker has stopped
+// publishing.
+func staleStatus(s Status) Status {
+	s.Free = false
+	s.Weight = 0
+	s.Reason = "Stale status"
+	s.reasonCode = "stale"
+	return s
+}
+
+// staleHandler serves a stale status as not free. This is rare, so it is
+// encoded per request.
+func staleHandler(w http.ResponseWriter, r *http.Request, s Status, format string) {
+	s = staleStatus(s)
+
+	out, err := formats[format].Encode(&s)
+	if err != nil {
+		http.Error(w, "Internal Server Error", 503)
+		return
+	}
+	signBody(w, out)
+	writeStatusHeader(w, s, http.StatusServiceUnavailable)
+	if r.Method != http.MethodHead {
+		w.Write(out)
 	}
-	status.Unlock()
 }
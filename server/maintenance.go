@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MaintenanceDrain = "drain"
+	MaintenanceHard  = "hard"
+)
+
+// Maintenance is the content of the maintenance file. An empty file gives
+// an empty Maintenance, which is the legacy behavior.
+type Maintenance struct {
+	Reason string `json:"reason,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
+	Until  int64  `json:"until,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+// Expired returns true if the maintenance has an expiry that has passed.
+func (m *Maintenance) Expired(now time.Time) bool {
+	return m.Until != 0 && now.Unix() >= m.Until
+}
+
+// ReadMaintenance reads the maintenance file at path. It returns nil if the
+// file does not exist. A file that can not be read or parsed still puts the
+// node in maintenance mode, with the problem as the reason.
+func ReadMaintenance(path string) (*Maintenance, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return &Maintenance{Reason: "Unreadable maintenance file"}, err
+	}
+
+	m, err := ParseMaintenance(data)
+	if err != nil {
+		return &Maintenance{Reason: "Malformed maintenance file"}, err
+	}
+	return m, nil
+}
+
+// ParseMaintenance parses the content of a maintenance file, which is either
+// empty, a JSON object or key=value lines.
+func ParseMaintenance(data []byte) (*Maintenance, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return &Maintenance{}, nil
+	}
+
+	values := make(map[string]string)
+	if data[0] == '{' {
+		var raw map[string]interface{}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&raw); err != nil {
+			return nil, err
+		}
+		for k, v := range raw {
+			switch v := v.(type) {
+			case string:
+				values[k] = v
+			case json.Number:
+				values[k] = v.String()
+			default:
+				return nil, fmt.Errorf("invalid value for %v", k)
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid line: %v", line)
+			}
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	var m Maintenance
+	for k, v := range values {
+		switch k {
+		case "reason":
+			m.Reason = v
+		case "owner":
+			m.Owner = v
+		case "ticket":
+			m.Ticket = v
+		case "until":
+			until, err := parseUntil(v)
+			if err != nil {
+				return nil, err
+			}
+			m.Until = until
+		case "mode":
+			if v != MaintenanceDrain && v != MaintenanceHard {
+				return nil, fmt.Errorf("invalid mode: %v", v)
+			}
+			m.Mode = v
+		default:
+			return nil, fmt.Errorf("unknown key: %v", k)
+		}
+	}
+	return &m, nil
+}
+
+// The expiry is either a unix timestamp or in RFC 3339 format.
+func parseUntil(s string) (int64, error) {
+	if until, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return until, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid until: %v", s)
+	}
+	return t.Unix(), nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of maintenance changes kept in the audit trail
+const auditSize = 100
+
+type MaintenanceEvent struct {
+	Time        int64        `json:"time"`
+	Action      string       `json:"action"`
+	Who         string       `json:"who"`
+	Client      string       `json:"client"`
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+}
+
+type AuditTrail struct {
+	events []MaintenanceEvent
+	sync.Mutex
+}
+
+var audit AuditTrail
+
+func (a *AuditTrail) Add(e MaintenanceEvent) {
+	a.Lock()
+	a.events = append(a.events, e)
+	if len(a.events) > auditSize {
+		a.events = a.events[len(a.events)-auditSize:]
+	}
+	a.Unlock()
+
+	log.Printf("Maintenance %s by %s from %s\n", e.Action, e.Who, e.Client)
+}
+
+func (a *AuditTrail) Events() []MaintenanceEvent {
+	a.Lock()
+	defer a.Unlock()
+	return append([]MaintenanceEvent{}, a.events...)
+}
+
+// WriteMaintenance atomically replaces the maintenance file, so that the
+// worker never reads a partially written file.
+func WriteMaintenance(path string, m *Maintenance) error {
+	out, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, append(out, '\n'), 0644, -1)
+}
+
+// RemoveMaintenance removes the maintenance file. A file that does not exist
+// is not an error.
+func RemoveMaintenance(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// authorized returns who made the request, or false if the request has
+// neither the maintenance token nor a verified client certificate matching
+// the maintenance patterns of the listener.
+func authorized(r *http.Request) (string, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		if l := requestListener(r); l != nil && CertMatches(cert, l.TLSMaintenanceAllow) {
+			return cert.Subject.CommonName, true
+		}
+	}
+
+	expected := Conf().MaintenanceToken
+	auth := r.Header.Get("Authorization")
+	if expected == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return "", false
+	}
+	return "token", true
+}
+
+type maintenanceRequest struct {
+	Reason string `json:"reason"`
+	Owner  string `json:"owner"`
+	Ticket string `json:"ticket"`
+	TTL    string `json:"ttl"`
+	Mode   string `json:"mode"`
+}
+
+func parseMaintenanceRequest(r *http.Request) (*Maintenance, error) {
+	var req maintenanceRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		req.Reason = r.Form.Get("reason")
+		req.Owner = r.Form.Get("owner")
+		req.Ticket = r.Form.Get("ticket")
+		req.TTL = r.Form.Get("ttl")
+		req.Mode = r.Form.Get("mode")
+	}
+
+	m := &Maintenance{
+		Reason: req.Reason,
+		Owner:  req.Owner,
+		Ticket: req.Ticket,
+		Mode:   req.Mode,
+	}
+	if m.Mode != "" && m.Mode != MaintenanceDrain && m.Mode != MaintenanceHard {
+		return nil, fmt.Errorf("invalid mode: %v", m.Mode)
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl: %v", req.TTL)
+		}
+		m.Until = time.Now().Add(ttl).Unix()
+	}
+	return m, nil
+}
+
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	who, ok := authorized(r)
+	if !ok {
+		unauthorized(w)
+		return
+	}
+
+	e := MaintenanceEvent{
+		Time:   time.Now().Unix(),
+		Who:    who,
+		Client: r.RemoteAddr,
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		m, err := parseMaintenanceRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if m.Owner != "" {
+			e.Who += " (" + m.Owner + ")"
+		}
+		if err := WriteMaintenance(Conf().Maintenance, m); err != nil {
+			log.Println("Unable to write maintenance file:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		e.Action = "enabled"
+		e.Maintenance = m
+	case http.MethodDelete:
+		if err := RemoveMaintenance(Conf().Maintenance); err != nil {
+			log.Println("Unable to remove maintenance file:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		e.Action = "disabled"
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	audit.Add(e)
+	Wake()
+
+	writeJSON(w, e)
+}
+
+func maintenanceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorized(r); !ok {
+		unauthorized(w)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, audit.Events())
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if out, err := json.MarshalIndent(v, "", "    "); err != nil {
+		http.Error(w, "Internal Server Error", 503)
+	} else {
+		w.Write(out)
+	}
+}
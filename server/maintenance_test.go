@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseMaintenance(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected Maintenance
+		err      bool
+	}{
+		{name: "empty", data: ""},
+		{name: "whitespace", data: " \n\t\n"},
+		{
+			name:     "key=value",
+			data:     "# comment\nreason = Kernel upgrade\nowner=alice\nticket=OPS-1\nuntil=1700000000\nmode=drain\n",
+			expected: Maintenance{Reason: "Kernel upgrade", Owner: "alice", Ticket: "OPS-1", Until: 1700000000, Mode: MaintenanceDrain},
+		},
+		{
+			name:     "key=value with RFC 3339 until",
+			data:     "until=2023-11-14T22:13:20Z",
+			expected: Maintenance{Until: 1700000000},
+		},
+		{
+			name:     "JSON",
+			data:     `{"reason": "Kernel upgrade", "owner": "alice", "ticket": "OPS-1", "until": 1700000000, "mode": "hard"}`,
+			expected: Maintenance{Reason: "Kernel upgrade", Owner: "alice", Ticket: "OPS-1", Until: 1700000000, Mode: MaintenanceHard},
+		},
+		{
+			name:     "JSON with RFC 3339 until",
+			data:     `{"until": "2023-11-14T22:13:20Z"}`,
+			expected: Maintenance{Until: 1700000000},
+		},
+		{name: "bad mode", data: "mode=soft", err: true},
+		{name: "bad JSON mode", data: `{"mode": "soft"}`, err: true},
+		{name: "bad until", data: "until=tomorrow", err: true},
+		{name: "bad JSON until", data: `{"until": true}`, err: true},
+		{name: "unknown key", data: "color=red", err: true},
+		{name: "unknown JSON key", data: `{"color": "red"}`, err: true},
+		{name: "line without =", data: "reason", err: true},
+		{name: "malformed JSON", data: `{"reason": `, err: true},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMaintenance([]byte(test.data))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if *m != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.name, *m, test.expected)
+		}
+	}
+}
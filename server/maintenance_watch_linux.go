@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// WatchMaintenance watches the directory of the maintenance file with
+// inotify, and wakes the worker when the file is created, removed or written
+// to.
+func WatchMaintenance(path string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+
+	mask := uint32(syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO |
+		syscall.IN_MOVED_FROM | syscall.IN_CLOSE_WRITE)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+		name := filepath.Base(path)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				log.Println("Unable to watch maintenance file, polling on the interval only:", err)
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				start := offset + syscall.SizeofInotifyEvent
+				offset = start + int(event.Len)
+
+				if event.Mask&syscall.IN_IGNORED != 0 {
+					log.Println("Maintenance file directory is no longer watched, polling on the interval only")
+					return
+				}
+				if string(bytes.TrimRight(buf[start:offset], "\x00")) != name {
+					continue
+				}
+				Wake()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// WatchMaintenance is only supported on Linux. Elsewhere the maintenance
+// file is polled on the interval.
+func WatchMaintenance(path string) error {
+	return nil
+}
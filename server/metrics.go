@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+func value(v float64, labels ...string) sample {
+	return sample{labels: labels, value: v}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Kinds of reasons, a fixed set so that free text reasons, such as those of
+// maintenance, do not make a series each
+var reasonCodes = []string{"normal", "network", "load", "draining", "slow_start", "maintenance", "collector", "shutting_down", "stale"}
+
+// MetricsWriter writes metrics in the Prometheus text format, or in the
+// OpenMetrics format.
+type MetricsWriter struct {
+	w           io.Writer
+	openMetrics bool
+}
+
+// Write writes a metric family. The labels of a sample are name and value
+// pairs.
+func (m *MetricsWriter) Write(name string, typ string, help string, samples ...sample) {
+	family := name
+	if m.openMetrics && typ == "counter" {
+		family = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(m.w, "# HELP %s %s\n", family, help)
+	fmt.Fprintf(m.w, "# TYPE %s %s\n", family, typ)
+
+	for _, s := range samples {
+		var labels []string
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			labels = append(labels, s.labels[i]+`="`+escapeLabel(s.labels[i+1])+`"`)
+		}
+		if len(labels) > 0 {
+			fmt.Fprintf(m.w, "%s{%s} %s\n", name, strings.Join(labels, ","), strconv.FormatFloat(s.value, 'g', -1, 64))
+		} else {
+			fmt.Fprintf(m.w, "%s %s\n", name, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+}
+
+func (m *MetricsWriter) Close() {
+	if m.openMetrics {
+		fmt.Fprint(m.w, "# EOF\n")
+	}
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// WriteMetrics writes every collected metric and the state of the node.
+func WriteMetrics(m *MetricsWriter, s *Status) {
+	if s.Stale() {
+		stale := staleStatus(*s)
+		s = &stale
+	}
+
+	m.Write("nodestatus_free", "gauge", "Whether the node has resources to handle more clients.",
+		value(boolValue(s.Free)))
+	m.Write("nodestatus_weight", "gauge", "Capacity score of the node, from 0 to 100.",
+		value(float64(s.Weight)))
+	var reasons []sample
+	for _, c := range reasonCodes {
+		reasons = append(reasons, value(boolValue(c == s.reasonCode), "reason", c))
+	}
+	m.Write("nodestatus_reason", "gauge", "The kind of reason for the state of the node.", reasons...)
+	m.Write("nodestatus_maintenance", "gauge", "Whether the node is in maintenance mode.",
+		value(boolValue(s.Maintenance != nil)))
+	m.Write("nodestatus_stale", "gauge", "Whether the status has not been updated recently.",
+		value(boolValue(s.Stale())))
+
+	if s.Ramp != nil {
+		m.Write("nodestatus_ramp_progress_percent", "gauge", "Progress of an ongoing drain or slow start.",
+			value(float64(s.Ramp.Progress), "mode", s.Ramp.Mode))
+	}
+
+	if _, ok := s.Collectors["net"]; ok {
+		m.Write("nodestatus_net_bandwidth_bps", "gauge", "Network bandwidth in bits per second, the highest of transmit and receive.",
+			value(float64(s.bps), "device", s.netDevice))
+		m.Write("nodestatus_net_threshold_bps", "gauge", "Network bandwidth threshold in bits per second.",
+			value(float64(s.netThreshold), "device", s.netDevice))
+		m.Write("nodestatus_net_utilization_percent", "gauge", "Network bandwidth in percent of the threshold.",
+			value(float64(s.NetUtilization), "device", s.netDevice))
+		m.Write("nodestatus_net_weight", "gauge", "Capacity score from the network headroom.",
+			value(float64(s.netWeight)))
+	}
+
+	if _, ok := s.Collectors["load"]; ok {
+		m.Write("nodestatus_load1", "gauge", "Load average over 1 minute.", value(s.Load1))
+		m.Write("nodestatus_load5", "gauge", "Load average over 5 minutes.", value(s.Load5))
+		m.Write("nodestatus_load15", "gauge", "Load average over 15 minutes.", value(s.Load15))
+		m.Write("nodestatus_load_threshold", "gauge", "Load average threshold, 0 when disabled.",
+			value(s.loadThreshold))
+		m.Write("nodestatus_load_weight", "gauge", "Capacity score from the load headroom.",
+			value(float64(s.loadWeight)))
+	}
+
+	var up, errors, age []sample
+	for _, name := range []string{"net", "load", "hostname"} {
+		cs, ok := s.Collectors[name]
+		if !ok {
+			continue
+		}
+		up = append(up, value(boolValue(cs.State == CollectorOK), "collector", name))
+		errors = append(errors, value(float64(cs.Errors), "collector", name))
+		age = append(age, value(float64(cs.Age), "collector", name))
+	}
+	m.Write("nodestatus_collector_up", "gauge", "Whether the last read of the collector succeeded.", up...)
+	m.Write("nodestatus_collector_errors_total", "counter", "Number of failed reads of the collector.", errors...)
+	m.Write("nodestatus_collector_age_seconds", "gauge", "Age of the last good value of the collector.", age...)
+
+	var names []string
+	listenerStats.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+	var blocked, limited []sample
+	for _, name := range names {
+		stats := statsFor(name)
+		blocked = append(blocked, value(float64(atomic.LoadUint64(&stats.Blocked)), "listener", name))
+		limited = append(limited, value(float64(atomic.LoadUint64(&stats.Limited)), "listener", name))
+	}
+	m.Write("nodestatus_http_requests_blocked_total", "counter", "Number of requests from clients not allowed on the listener.", blocked...)
+	m.Write("nodestatus_http_requests_limited_total", "counter", "Number of requests over the rate limit of the listener.", limited...)
+
+	m.Write("nodestatus_uptime_seconds", "gauge", "Uptime of the process.", value(float64(s.Uptime)))
+	m.Write("nodestatus_build_info", "gauge", "Build information.",
+		value(1, "version", version, "goversion", runtime.Version()))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	s := CurrentSnapshot().Status
+	gzipHandler(func(w http.ResponseWriter, r *http.Request) {
+		m := &MetricsWriter{w: w, openMetrics: openMetrics}
+		WriteMetrics(m, &s)
+		m.Close()
+	})(w, r)
+}
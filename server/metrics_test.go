@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	metricsComment = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.+)$`)
+	metricsSample  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{([a-zA-Z_][a-zA-Z0-9_]*="(\\.|[^"\\])*",?)*\})? (\S+)$`)
+)
+
+// parseMetrics parses the Prometheus text format, and returns the samples by
+// name and labels.
+func parseMetrics(t *testing.T, body string) map[string]float64 {
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := metricsComment.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				types[m[2]] = m[3]
+			}
+			continue
+		}
+
+		m := metricsSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("invalid line: %q", line)
+		}
+		if _, ok := types[m[1]]; !ok {
+			t.Fatalf("sample without type: %q", line)
+		}
+		v, err := strconv.ParseFloat(m[5], 64)
+		if err != nil {
+			t.Fatalf("invalid value: %q", line)
+		}
+		samples[m[1]+m[2]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	config.Store(&Config{Interval: 3600})
+	s := benchmarkStatus()
+	s.Free = false
+	s.Reason = `Maintenance mode: "quoted" \\ reason`
+	s.reasonCode = "maintenance"
+	s.bps = 99000000
+	s.netDevice = "eth0"
+	s.Collectors["net"].Errors = 3
+	if err := Publish(s); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	samples := parseMetrics(t, w.Body.String())
+
+	expected := map[string]float64{
+		`nodestatus_free`:   0,
+		`nodestatus_weight`: 91,
+		`nodestatus_net_bandwidth_bps{device="eth0"}`: 99000000,
+		`nodestatus_load1`: 2.15,
+		`nodestatus_collector_errors_total{collector="net"}`: 3,
+		`nodestatus_collector_up{collector="load"}`:          1,
+		`nodestatus_uptime_seconds`:                          2,
+		`nodestatus_reason{reason="maintenance"}`:            1,
+		`nodestatus_reason{reason="normal"}`:                 0,
+		`nodestatus_reason{reason="stale"}`:                  0,
+	}
+	for name, v := range expected {
+		if got, ok := samples[name]; !ok || got != v {
+			t.Errorf("%s: got %v, expected %v", name, got, v)
+		}
+	}
+
+	// The free text reason must not make a series of its own
+	reasons := 0
+	for name := range samples {
+		if strings.HasPrefix(name, "nodestatus_reason{") {
+			reasons++
+		}
+	}
+	if reasons != len(reasonCodes) {
+		t.Errorf("got %d reason series, expected %d", reasons, len(reasonCodes))
+	}
+}
+
+func TestMetricsStale(t *testing.T) {
+	config.Store(&Config{Interval: 1})
+	s := benchmarkStatus()
+	s.reasonCode = "normal"
+	s.updated = time.Now().Add(-time.Minute)
+	if err := Publish(s); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	samples := parseMetrics(t, w.Body.String())
+
+	// A stuck worker is not free, as on the status routes
+	expected := map[string]float64{
+		`nodestatus_free`:                    0,
+		`nodestatus_weight`:                  0,
+		`nodestatus_stale`:                   1,
+		`nodestatus_reason{reason="stale"}`:  1,
+		`nodestatus_reason{reason="normal"}`: 0,
+	}
+	for name, v := range expected {
+		if got, ok := samples[name]; !ok || got != v {
+			t.Errorf("%s: got %v, expected %v", name, got, v)
+		}
+	}
+}
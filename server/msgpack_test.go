@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// msgpackMap returns a map with n keys, and the encoding of its entries.
+func msgpackMap(n int) (map[string]interface{}, []byte) {
+	m := make(map[string]interface{})
+	var entries []byte
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("k%02d", i)
+		m[k] = json.Number("1")
+		entries = append(entries, 0xa3)
+		entries = append(entries, k...)
+		entries = append(entries, 0x01)
+	}
+	return m, entries
+}
+
+func msgpackArray(n int) ([]interface{}, []byte) {
+	a := make([]interface{}, n)
+	for i := range a {
+		a[i] = true
+	}
+	return a, bytes.Repeat([]byte{0xc3}, n)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	str31 := strings.Repeat("a", 31)
+	str32 := strings.Repeat("a", 32)
+	str255 := strings.Repeat("a", 255)
+	str256 := strings.Repeat("a", 256)
+	map15, entries15 := msgpackMap(15)
+	map16, entries16 := msgpackMap(16)
+	array15, elements15 := msgpackArray(15)
+	array16, elements16 := msgpackArray(16)
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"false", false, []byte{0xc2}},
+		{"true", true, []byte{0xc3}},
+		{"zero", json.Number("0"), []byte{0x00}},
+		{"positive fixint", json.Number("127"), []byte{0x7f}},
+		{"int64 above fixint", json.Number("128"), []byte{0xd3, 0, 0, 0, 0, 0, 0, 0, 0x80}},
+		{"negative fixint", json.Number("-1"), []byte{0xff}},
+		{"lowest negative fixint", json.Number("-32"), []byte{0xe0}},
+		{"int64 below negative fixint", json.Number("-33"), []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xdf}},
+		{"float64", json.Number("1.5"), []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"empty string", "", []byte{0xa0}},
+		{"fixstr", str31, concat([]byte{0xbf}, []byte(str31))},
+		{"str8", str32, concat([]byte{0xd9, 32}, []byte(str32))},
+		{"largest str8", str255, concat([]byte{0xd9, 255}, []byte(str255))},
+		{"str16", str256, concat([]byte{0xda, 0x01, 0x00}, []byte(str256))},
+		{"empty array", []interface{}{}, []byte{0x90}},
+		{"fixarray", array15, concat([]byte{0x9f}, elements15)},
+		{"array16", array16, concat([]byte{0xdc, 0x00, 0x10}, elements16)},
+		{"empty map", map[string]interface{}{}, []byte{0x80}},
+		{"sorted keys", map[string]interface{}{"b": json.Number("1"), "a": json.Number("2")},
+			[]byte{0x82, 0xa1, 'a', 0x02, 0xa1, 'b', 0x01}},
+		{"fixmap", map15, concat([]byte{0x8f}, entries15)},
+		{"map16", map16, concat([]byte{0xde, 0x00, 0x10}, entries16)},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := EncodeMsgpack(&buf, test.value); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("%s: got % x, expected % x", test.name, buf.Bytes(), test.expected)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeMsgpack(&buf, 1.5); err == nil {
+		t.Error("float64: expected an error for a type that is not decoded JSON")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// liveHandler responds as long as the process is up.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write([]byte("OK\n"))
+	}
+}
+
+// readyHandler responds with 200 if the node is free, and 503 with the
+// reason if not.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	s := CurrentSnapshot().Status
+	code := http.StatusOK
+	if s.Stale() {
+		s = staleStatus(s)
+	}
+	if !s.Free {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=1")
+	writeStatusHeader(w, s, code)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(s.Reason + "\n"))
+	}
+}
+
+// collectorHandler serves the data of a single collector, at
+// /status/{collector}.
+func collectorHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/status/")
+	s := CurrentSnapshot().Status
+	cs, ok := s.Collectors[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := map[string]interface{}{
+		"state":  cs.State,
+		"age":    cs.Age,
+		"errors": cs.Errors,
+	}
+	if cs.LastError != "" {
+		data["last-error"] = cs.LastError
+	}
+	switch name {
+	case "net":
+		data["net"] = s.Net
+		data["net-threshold"] = s.NetThreshold
+		data["net-utilization"] = s.NetUtilization
+	case "load":
+		data["load1"] = s.Load1
+		data["load5"] = s.Load5
+		data["load15"] = s.Load15
+	case "hostname":
+		data["hostname"] = s.Hostname
+	}
+
+	gzipHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=1")
+		if out, err := json.MarshalIndent(data, "", "    "); err != nil {
+			http.Error(w, "Internal Server Error", 503)
+		} else {
+			w.Write(out)
+		}
+	})(w, r)
+}
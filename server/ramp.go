@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	RampDrain     = "drain"
+	RampSlowStart = "slow-start"
+)
+
+// Ramp is the progress of an ongoing drain or slow start, as published in the
+// status.
+type Ramp struct {
+	Mode      string `json:"mode"`
+	Progress  int    `json:"progress"`
+	Remaining int    `json:"remaining"`
+}
+
+// Ramper moves the advertised weight gradually down when entering
+// maintenance mode and gradually up when leaving it.
+type Ramper struct {
+	Drain     time.Duration
+	SlowStart time.Duration
+
+	mode        string
+	start       time.Time
+	maintenance bool
+	initialized bool
+}
+
+// Update returns the share of the weight to advertise, and the progress of
+// the ramp if one is ongoing. Hard maintenance skips the drain.
+func (r *Ramper) Update(maintenance bool, hard bool, now time.Time) (float64, *Ramp) {
+	// The state at startup is taken as is, without ramping
+	if !r.initialized {
+		r.initialized = true
+		r.maintenance = maintenance
+	}
+
+	if maintenance != r.maintenance {
+		// Start from the current share, so that a drain during a slow start
+		// (or the other way around) continues where the previous ramp was.
+		factor := r.factor(now)
+		r.maintenance = maintenance
+		r.mode = ""
+		if maintenance && !hard && r.Drain > 0 {
+			r.mode = RampDrain
+			r.start = now.Add(-time.Duration((1 - factor) * float64(r.Drain)))
+		}
+		if !maintenance && r.SlowStart > 0 {
+			r.mode = RampSlowStart
+			r.start = now.Add(-time.Duration(factor * float64(r.SlowStart)))
+		}
+	}
+
+	// Switching to hard maintenance ends an ongoing drain
+	if hard && r.mode == RampDrain {
+		r.mode = ""
+	}
+
+	factor := r.factor(now)
+	if r.mode == "" {
+		return factor, nil
+	}
+
+	period := r.period()
+	elapsed := now.Sub(r.start)
+	if elapsed >= period {
+		r.mode = ""
+		return r.factor(now), nil
+	}
+	return factor, &Ramp{
+		Mode:      r.mode,
+		Progress:  int(100 * elapsed / period),
+		Remaining: int((period - elapsed).Seconds() + 0.5),
+	}
+}
+
+func (r *Ramper) period() time.Duration {
+	if r.mode == RampDrain {
+		return r.Drain
+	}
+	return r.SlowStart
+}
+
+func (r *Ramper) factor(now time.Time) float64 {
+	if r.mode == "" {
+		if r.maintenance {
+			return 0
+		}
+		return 1
+	}
+	f := float64(now.Sub(r.start)) / float64(r.period())
+	if f > 1 {
+		f = 1
+	}
+	if r.mode == RampDrain {
+		return 1 - f
+	}
+	return f
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRamper(t *testing.T) {
+	type step struct {
+		at          int // seconds
+		maintenance bool
+		hard        bool
+		factor      float64
+		ramp        *Ramp
+	}
+	tests := []struct {
+		name      string
+		drain     time.Duration
+		slowStart time.Duration
+		steps     []step
+	}{
+		{
+			name:  "maintenance at startup",
+			drain: 10 * time.Second,
+			steps: []step{
+				{at: 0, maintenance: true, factor: 0},
+				{at: 5, maintenance: true, factor: 0},
+			},
+		},
+		{
+			name:  "drain completing",
+			drain: 10 * time.Second,
+			steps: []step{
+				{at: 0, factor: 1},
+				{at: 1, maintenance: true, factor: 1, ramp: &Ramp{Mode: RampDrain, Progress: 0, Remaining: 10}},
+				{at: 6, maintenance: true, factor: 0.5, ramp: &Ramp{Mode: RampDrain, Progress: 50, Remaining: 5}},
+				{at: 11, maintenance: true, factor: 0},
+				{at: 12, maintenance: true, factor: 0},
+			},
+		},
+		{
+			name:      "slow start completing",
+			slowStart: 20 * time.Second,
+			steps: []step{
+				{at: 0, maintenance: true, factor: 0},
+				{at: 1, factor: 0, ramp: &Ramp{Mode: RampSlowStart, Progress: 0, Remaining: 20}},
+				{at: 16, factor: 0.75, ramp: &Ramp{Mode: RampSlowStart, Progress: 75, Remaining: 5}},
+				{at: 21, factor: 1},
+			},
+		},
+		{
+			name:      "reversal halfway through a drain",
+			drain:     10 * time.Second,
+			slowStart: 20 * time.Second,
+			steps: []step{
+				{at: 0, factor: 1},
+				{at: 1, maintenance: true, factor: 1, ramp: &Ramp{Mode: RampDrain, Progress: 0, Remaining: 10}},
+				{at: 6, maintenance: true, factor: 0.5, ramp: &Ramp{Mode: RampDrain, Progress: 50, Remaining: 5}},
+				{at: 6, factor: 0.5, ramp: &Ramp{Mode: RampSlowStart, Progress: 50, Remaining: 10}},
+				{at: 11, factor: 0.75, ramp: &Ramp{Mode: RampSlowStart, Progress: 75, Remaining: 5}},
+				{at: 16, factor: 1},
+			},
+		},
+		{
+			name:  "hard maintenance skipping the drain",
+			drain: 10 * time.Second,
+			steps: []step{
+				{at: 0, factor: 1},
+				{at: 1, maintenance: true, hard: true, factor: 0},
+			},
+		},
+		{
+			name:  "hard maintenance cutting a drain short",
+			drain: 10 * time.Second,
+			steps: []step{
+				{at: 0, factor: 1},
+				{at: 1, maintenance: true, factor: 1, ramp: &Ramp{Mode: RampDrain, Progress: 0, Remaining: 10}},
+				{at: 6, maintenance: true, hard: true, factor: 0},
+				{at: 7, maintenance: true, factor: 0},
+			},
+		},
+		{
+			name: "zero periods",
+			steps: []step{
+				{at: 0, factor: 1},
+				{at: 1, maintenance: true, factor: 0},
+				{at: 2, factor: 1},
+			},
+		},
+	}
+
+	start := time.Unix(1560944655, 0)
+	for _, test := range tests {
+		r := Ramper{Drain: test.drain, SlowStart: test.slowStart}
+		for i, step := range test.steps {
+			factor, ramp := r.Update(step.maintenance, step.hard, start.Add(time.Duration(step.at)*time.Second))
+			if math.Abs(factor-step.factor) > 1e-9 {
+				t.Errorf("%s, step %d: got factor %v, expected %v", test.name, i, factor, step.factor)
+			}
+			switch {
+			case ramp == nil && step.ramp == nil:
+			case ramp == nil || step.ramp == nil || *ramp != *step.ramp:
+				t.Errorf("%s, step %d: got ramp %+v, expected %+v", test.name, i, ramp, step.ramp)
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SdNotify sends a state to systemd. It does nothing unless started by
+// systemd with a notification socket.
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Watchdog pings the systemd watchdog at half of its timeout, as long as the
+// status is fresh. A stuck worker then gets the process restarted.
+func Watchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+		if !CurrentSnapshot().Status.Stale() {
+			SdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var closeOnce sync.Once
+
+// Serve starts serving the listeners, over HTTPS for those with TLS, and
+// returns once listening. Handlers are given by route.
+func Serve(listeners []*ListenerConfig, handlers map[string]http.HandlerFunc) ([]*http.Server, error) {
+	var servers []*http.Server
+	for _, l := range listeners {
+		tc, err := TLSConfig(l)
+		if err != nil {
+			return nil, err
+		}
+		lns, err := l.Listen()
+		if err != nil {
+			return nil, err
+		}
+
+		srv := &http.Server{Handler: l.Handler(handlers), TLSConfig: tc}
+		srv.RegisterOnShutdown(func() {
+			closeOnce.Do(func() {
+				close(closing)
+			})
+		})
+		for _, ln := range lns {
+			go serve(srv, ln, l, tc != nil)
+		}
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+func serve(srv *http.Server, ln net.Listener, l *ListenerConfig, secure bool) {
+	var err error
+	if secure {
+		log.Printf("Listener %s listening with TLS at %s\n", l.Name, ln.Addr())
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		log.Printf("Listener %s listening at %s\n", l.Name, ln.Addr())
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// HandleSignals handles signals until the server has been shut down.
+//
+// SIGTERM and SIGINT advertise the node as not free for the shutdown grace
+// period before shutting the server down, SIGUSR1 toggles maintenance mode
+// and SIGHUP reloads the configuration.
+func HandleSignals(servers []*http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGHUP)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			toggleMaintenance()
+		case syscall.SIGHUP:
+			ReloadConfig(*configFilePathFlag)
+		case syscall.SIGTERM, syscall.SIGINT:
+			shutdown(servers, signals)
+			return
+		}
+	}
+}
+
+func toggleMaintenance() {
+	e := MaintenanceEvent{
+		Time:   time.Now().Unix(),
+		Who:    "signal",
+		Client: "SIGUSR1",
+	}
+
+	// An expired maintenance file is not maintenance mode, so it is replaced
+	m, _ := ReadMaintenance(Conf().Maintenance)
+	if m == nil || m.Expired(time.Now()) {
+		m = &Maintenance{Reason: "Toggled by signal"}
+		if err := WriteMaintenance(Conf().Maintenance, m); err != nil {
+			log.Println("Unable to write maintenance file:", err)
+			return
+		}
+		e.Action = "enabled"
+		e.Maintenance = m
+	} else {
+		if err := RemoveMaintenance(Conf().Maintenance); err != nil {
+			log.Println("Unable to remove maintenance file:", err)
+			return
+		}
+		e.Action = "disabled"
+	}
+	audit.Add(e)
+	Wake()
+}
+
+func shutdown(servers []*http.Server, signals <-chan os.Signal) {
+	log.Println("Shutting down in " + Conf().ShutdownGrace.String())
+	atomic.StoreInt32(&shuttingDown, 1)
+	Wake()
+
+	// A second signal skips the rest of the grace period
+	select {
+	case <-time.After(Conf().ShutdownGrace):
+	case <-signals:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println("Unable to shut down gracefully:", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SignHMAC    = "hmac-sha256"
+	SignEd25519 = "ed25519"
+)
+
+// Signer signs status payloads, either with a key shared with the master
+// (HMAC-SHA256) or with the private key of the node (Ed25519).
+type Signer struct {
+	Algorithm string
+
+	secret     []byte
+	privateKey ed25519.PrivateKey
+}
+
+// LoadSigner reads the key at path. An HMAC key is the content of the file,
+// without surrounding whitespace. An Ed25519 key is a PKCS #8 PEM private key,
+// as made by "openssl genpkey -algorithm ed25519".
+func LoadSigner(algorithm string, path string) (*Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Signer{Algorithm: algorithm}
+	switch algorithm {
+	case SignHMAC:
+		s.secret = bytes.TrimSpace(data)
+		if len(s.secret) == 0 {
+			return nil, errors.New("empty key in " + path)
+		}
+	case SignEd25519:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM data in " + path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 key in " + path)
+		}
+		s.privateKey = privateKey
+	default:
+		return nil, fmt.Errorf("unknown signing algorithm: %v", algorithm)
+	}
+	return s, nil
+}
+
+// SignedMessage is what is signed: the timestamp, the nonce and the body,
+// separated by newlines.
+func SignedMessage(timestamp int64, nonce string, body []byte) []byte {
+	msg := []byte(strconv.FormatInt(timestamp, 10) + "\n" + nonce + "\n")
+	return append(msg, body...)
+}
+
+// Sign returns the signature header of the body, with a fresh timestamp and
+// nonce so that the master can tell a replayed response.
+func (s *Signer) Sign(body []byte, now time.Time) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+	msg := SignedMessage(now.Unix(), nonce, body)
+
+	var sig []byte
+	if s.Algorithm == SignHMAC {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(msg)
+		sig = mac.Sum(nil)
+	} else {
+		sig = ed25519.Sign(s.privateKey, msg)
+	}
+	return fmt.Sprintf("alg=%s, ts=%d, nonce=%s, sig=%s",
+		s.Algorithm, now.Unix(), nonce, base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// signBody sets the signature header of the uncompressed body, if signing is
+// enabled.
+func signBody(w http.ResponseWriter, body []byte) {
+	signer := Conf().Signer
+	if signer == nil {
+		return
+	}
+	sig, err := signer.Sign(body, time.Now())
+	if err != nil {
+		log.Println("Unable to sign status:", err)
+		return
+	}
+	w.Header().Set("X-Node-Signature", sig)
+}
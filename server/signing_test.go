@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseSignature parses the X-Node-Signature header into its fields.
+func parseSignature(t *testing.T, header string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(header, ", ") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			t.Fatalf("invalid field %q in %q", field, header)
+		}
+		fields[kv[0]] = kv[1]
+	}
+	return fields
+}
+
+func TestSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := []byte("shared secret")
+	hmacPath := filepath.Join(dir, "hmac.key")
+	if err := ioutil.WriteFile(hmacPath, append(secret, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Path := filepath.Join(dir, "ed25519.pem")
+	if err := ioutil.WriteFile(ed25519Path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	body := []byte(`{"free": true}`)
+	for _, test := range []struct {
+		alg  string
+		path string
+	}{
+		{SignHMAC, hmacPath},
+		{SignEd25519, ed25519Path},
+	} {
+		signer, err := LoadSigner(test.alg, test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := signer.Sign(body, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := parseSignature(t, header)
+		if fields["alg"] != test.alg || fields["ts"] != strconv.FormatInt(now.Unix(), 10) {
+			t.Errorf("%s: unexpected header %q", test.alg, header)
+		}
+
+		sig, err := base64.StdEncoding.DecodeString(fields["sig"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := SignedMessage(now.Unix(), fields["nonce"], body)
+		var valid bool
+		if test.alg == SignHMAC {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(msg)
+			valid = hmac.Equal(sig, mac.Sum(nil))
+		} else {
+			valid = ed25519.Verify(publicKey, msg, sig)
+		}
+		if !valid {
+			t.Errorf("%s: invalid signature in %q", test.alg, header)
+		}
+
+		// Every signature has a fresh nonce
+		again, err := signer.Sign(body, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parseSignature(t, again)["nonce"] == fields["nonce"] {
+			t.Errorf("%s: nonce reused", test.alg)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is an immutable status together with its encodings. The worker
+// publishes one per update, so that handlers only have to copy bytes.
+type Snapshot struct {
+	Status     Status
+	JSON       []byte
+	Gzip       []byte
+	Generation uint64
+
+	// Generation of the last change of the status other than the time, the
+	// uptime and the age of the collectors, which long polls wait for
+	Changed uint64
+	state   []byte
+
+	// Closed when the next snapshot is published
+	updated chan struct{}
+
+	// Other formats and schemas are encoded on first use
+	encodings map[string]*encoding
+	v2        encoding
+}
+
+type encoding struct {
+	once sync.Once
+	body []byte
+	gzip []byte
+	err  error
+}
+
+// Encoded returns the status in the given format.
+func (snap *Snapshot) Encoded(format string) ([]byte, error) {
+	if format == "json" {
+		return snap.JSON, nil
+	}
+
+	e := snap.encodings[format]
+	e.once.Do(func() {
+		e.body, e.err = formats[format].Encode(&snap.Status)
+	})
+	return e.body, e.err
+}
+
+// Updated returns a channel that is closed when a newer snapshot is
+// published.
+func (snap *Snapshot) Updated() <-chan struct{} {
+	return snap.updated
+}
+
+// Generations start at the start of the process, so that they keep
+// increasing across restarts. The ETags are also prefixed with it, to never
+// match those of a previous run.
+var (
+	startNano       = time.Now().UnixNano()
+	generationStart = uint64(startNano)
+	etagEpoch       = strconv.FormatInt(startNano, 36)
+)
+
+// ETag returns the entity tag of the status in the given format, which
+// changes with every generation.
+func (snap *Snapshot) ETag(format string, gzipped bool) string {
+	etag := etagEpoch + "-" + strconv.FormatUint(snap.Generation, 10) + "-" + format
+	if gzipped {
+		etag += "-gzip"
+	}
+	return `"` + etag + `"`
+}
+
+var snapshot atomic.Value
+
+// Publish encodes the status and makes it the current snapshot. Only the
+// worker publishes, so snapshots are never published concurrently.
+func Publish(s Status) error {
+	out, err := json.MarshalIndent(&s, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	gz, err := Gzip(out)
+	if err != nil {
+		return err
+	}
+
+	encodings := make(map[string]*encoding)
+	for format := range formats {
+		encodings[format] = &encoding{}
+	}
+
+	state, err := stateOf(s)
+	if err != nil {
+		return err
+	}
+
+	// Every snapshot is a new generation, as its body differs at least in
+	// the time. Long polls only wait until the rest changes.
+	generation := generationStart + 1
+	changed := generation
+	prev, _ := snapshot.Load().(*Snapshot)
+	if prev != nil {
+		generation = prev.Generation + 1
+		changed = prev.Changed
+		if !bytes.Equal(prev.state, state) {
+			changed = generation
+		}
+	}
+
+	snapshot.Store(&Snapshot{
+		Status:     s,
+		JSON:       out,
+		Gzip:       gz,
+		Generation: generation,
+		Changed:    changed,
+		state:      state,
+		updated:    make(chan struct{}),
+		encodings:  encodings,
+	})
+
+	// Wake up the streams and long polls waiting for this update
+	if prev != nil {
+		close(prev.updated)
+	}
+	return nil
+}
+
+// stateOf encodes the status without the time, the uptime and the age of
+// the collectors, which change on every update.
+func stateOf(s Status) ([]byte, error) {
+	s.Time = 0
+	s.Uptime = 0
+	collectors := make(map[string]*CollectorStatus, len(s.Collectors))
+	for name, cs := range s.Collectors {
+		c := *cs
+		c.Age = 0
+		collectors[name] = &c
+	}
+	s.Collectors = collectors
+	return json.Marshal(&s)
+}
+
+// Gzip compresses data. Compressing once per update, the best compression is
+// affordable.
+func Gzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CurrentSnapshot returns the last published snapshot.
+func CurrentSnapshot() *Snapshot {
+	return snapshot.Load().(*Snapshot)
+}
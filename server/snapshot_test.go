@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func benchmarkStatus() Status {
+	return Status{
+		Free:           true,
+		Reason:         "Normal operation",
+		Load1:          2.15,
+		Load5:          1.83,
+		Load15:         1.72,
+		Net:            "99 Mbps",
+		NetThreshold:   "1.0 Gbps",
+		NetUtilization: 9,
+		Weight:         91,
+		Time:           time.Now().Unix(),
+		Uptime:         2,
+		Hostname:       "work-2.local",
+		Collectors: map[string]*CollectorStatus{
+			"hostname": {State: CollectorOK},
+			"load":     {State: CollectorOK},
+			"net":      {State: CollectorOK},
+		},
+		updated: time.Now(),
+	}
+}
+
+func benchmarkHandler(b *testing.B, handler http.HandlerFunc) {
+	config.Store(&Config{Interval: 3600})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("got status code %d", w.Code)
+		}
+	}
+}
+
+// Encoding and compressing on every request, as before snapshots
+func BenchmarkStatusPerRequest(b *testing.B) {
+	s := benchmarkStatus()
+	benchmarkHandler(b, gzipHandler(func(w http.ResponseWriter, r *http.Request) {
+		out, err := json.MarshalIndent(&s, "", "    ")
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.Write(out)
+	}))
+}
+
+func BenchmarkStatusSnapshot(b *testing.B) {
+	if err := Publish(benchmarkStatus()); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkHandler(b, statusHandler)
+}
+
+func TestPublishGeneration(t *testing.T) {
+	config.Store(&Config{Interval: 3600})
+	s := benchmarkStatus()
+	s.Reason = "Generation test"
+	if err := Publish(s); err != nil {
+		t.Fatal(err)
+	}
+	first := CurrentSnapshot()
+	if first.Changed != first.Generation {
+		t.Errorf("new state: changed at %d, expected %d", first.Changed, first.Generation)
+	}
+
+	// A new tick, with the same state, is a new generation without a change
+	s.Time++
+	s.Uptime++
+	s.Collectors = map[string]*CollectorStatus{
+		"hostname": {State: CollectorOK},
+		"load":     {State: CollectorOK},
+		"net":      {State: CollectorOK, Age: 3},
+	}
+	if err := Publish(s); err != nil {
+		t.Fatal(err)
+	}
+	snap := CurrentSnapshot()
+	if snap.Generation != first.Generation+1 || snap.Changed != first.Generation {
+		t.Errorf("same state: got generation %d changed at %d, expected %d changed at %d",
+			snap.Generation, snap.Changed, first.Generation+1, first.Generation)
+	}
+	if snap.ETag("json", false) == first.ETag("json", false) {
+		t.Error("same state: the ETag of a different body did not change")
+	}
+
+	s.Free = false
+	if err := Publish(s); err != nil {
+		t.Fatal(err)
+	}
+	snap = CurrentSnapshot()
+	if snap.Generation != first.Generation+2 || snap.Changed != snap.Generation {
+		t.Errorf("new state: got generation %d changed at %d, expected %d changed at %d",
+			snap.Generation, snap.Changed, first.Generation+2, first.Generation+2)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const SchemaVersion = 2
+
+// StatusV2 is the versioned status, with raw values in explicit units and a
+// section per collector.
+type StatusV2 struct {
+	SchemaVersion int               `json:"schema_version"`
+	Free          bool              `json:"free"`
+	Reason        string            `json:"reason"`
+	Weight        int               `json:"weight"`
+	Ramp          *RampV2           `json:"ramp,omitempty"`
+	Maintenance   *Maintenance      `json:"maintenance,omitempty"`
+	Time          int64             `json:"time"`
+	UptimeSeconds int               `json:"uptime_seconds"`
+	Node          NodeV2            `json:"node"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Collectors    CollectorsV2      `json:"collectors"`
+}
+
+// NodeV2 is the identity of the node and of the process.
+type NodeV2 struct {
+	ID        string `json:"id,omitempty"`
+	BootID    string `json:"boot_id,omitempty"`
+	MachineID string `json:"machine_id,omitempty"`
+	Version   string `json:"version"`
+	StartTime int64  `json:"start_time"`
+}
+
+type RampV2 struct {
+	Mode             string `json:"mode"`
+	ProgressPercent  int    `json:"progress_percent"`
+	RemainingSeconds int    `json:"remaining_seconds"`
+}
+
+type CollectorsV2 struct {
+	Net      *NetV2      `json:"net,omitempty"`
+	Load     *LoadV2     `json:"load,omitempty"`
+	Hostname *HostnameV2 `json:"hostname,omitempty"`
+}
+
+// CollectorV2 is the state of a collector, common to all sections.
+type CollectorV2 struct {
+	State      string `json:"state"`
+	AgeSeconds int    `json:"age_seconds"`
+	Errors     uint64 `json:"errors"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+type NetV2 struct {
+	CollectorV2
+	Interface          string `json:"interface"`
+	BandwidthBps       uint64 `json:"bandwidth_bps"`
+	ThresholdBps       uint64 `json:"threshold_bps"`
+	UtilizationPercent uint64 `json:"utilization_percent"`
+	Weight             int    `json:"weight"`
+}
+
+type LoadV2 struct {
+	CollectorV2
+	Load1     float64 `json:"load1"`
+	Load5     float64 `json:"load5"`
+	Load15    float64 `json:"load15"`
+	Threshold float64 `json:"threshold"`
+	Weight    int     `json:"weight"`
+}
+
+type HostnameV2 struct {
+	CollectorV2
+	Hostname string `json:"hostname"`
+}
+
+func NewStatusV2(s *Status) *StatusV2 {
+	v2 := &StatusV2{
+		SchemaVersion: SchemaVersion,
+		Free:          s.Free,
+		Reason:        s.Reason,
+		Weight:        s.Weight,
+		Maintenance:   s.Maintenance,
+		Time:          s.Time,
+		UptimeSeconds: s.Uptime,
+		Node: NodeV2{
+			ID:        s.NodeID,
+			BootID:    s.BootID,
+			MachineID: s.MachineID,
+			Version:   s.Version,
+			StartTime: s.StartTime,
+		},
+		Labels: s.Labels,
+	}
+	if s.Ramp != nil {
+		v2.Ramp = &RampV2{
+			Mode:             s.Ramp.Mode,
+			ProgressPercent:  s.Ramp.Progress,
+			RemainingSeconds: s.Ramp.Remaining,
+		}
+	}
+
+	if cs, ok := s.Collectors["net"]; ok {
+		v2.Collectors.Net = &NetV2{
+			CollectorV2:        newCollectorV2(cs),
+			Interface:          s.netDevice,
+			BandwidthBps:       s.bps,
+			ThresholdBps:       s.netThreshold,
+			UtilizationPercent: s.NetUtilization,
+			Weight:             s.netWeight,
+		}
+	}
+	if cs, ok := s.Collectors["load"]; ok {
+		v2.Collectors.Load = &LoadV2{
+			CollectorV2: newCollectorV2(cs),
+			Load1:       s.Load1,
+			Load5:       s.Load5,
+			Load15:      s.Load15,
+			Threshold:   s.loadThreshold,
+			Weight:      s.loadWeight,
+		}
+	}
+	if cs, ok := s.Collectors["hostname"]; ok {
+		v2.Collectors.Hostname = &HostnameV2{
+			CollectorV2: newCollectorV2(cs),
+			Hostname:    s.Hostname,
+		}
+	}
+	return v2
+}
+
+func newCollectorV2(cs *CollectorStatus) CollectorV2 {
+	return CollectorV2{
+		State:      cs.State,
+		AgeSeconds: cs.Age,
+		Errors:     cs.Errors,
+		LastError:  cs.LastError,
+	}
+}
+
+// V2 returns the status in the v2 schema, as JSON and compressed.
+func (snap *Snapshot) V2() ([]byte, []byte, error) {
+	e := &snap.v2
+	e.once.Do(func() {
+		e.body, e.err = json.MarshalIndent(NewStatusV2(&snap.Status), "", "    ")
+		if e.err == nil {
+			e.gzip, e.err = Gzip(e.body)
+		}
+	})
+	return e.body, e.gzip, e.err
+}
+
+func statusV2Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=1")
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	snap := CurrentSnapshot()
+	s := snap.Status
+	code := statusCode(s)
+	body, gz, err := snap.V2()
+	if s.Stale() {
+		// Rare, so encoded per request
+		s = staleStatus(s)
+		code = http.StatusServiceUnavailable
+		body, err = json.MarshalIndent(NewStatusV2(&s), "", "    ")
+		gz = nil
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", 503)
+		return
+	}
+
+	signBody(w, body)
+	if gz != nil && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		body = gz
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writeStatusHeader(w, s, code)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+func schemaV2Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write([]byte(schemaV2))
+}
+
+// JSON Schema of StatusV2
+const schemaV2 = `{
+    "$schema": "http://json-schema.org/draft-07/schema#",
+    "$id": "https://github.com/varnish/nodestatus/v2/schema.json",
+    "title": "Node status",
+    "type": "object",
+    "required": ["schema_version", "free", "reason", "weight", "time", "uptime_seconds", "collectors"],
+    "properties": {
+        "schema_version": {"const": 2},
+        "free": {"type": "boolean", "description": "The node has resources to handle more clients"},
+        "reason": {"type": "string"},
+        "weight": {"type": "integer", "minimum": 0, "maximum": 100, "description": "Capacity score"},
+        "ramp": {
+            "type": "object",
+            "required": ["mode", "progress_percent", "remaining_seconds"],
+            "properties": {
+                "mode": {"enum": ["drain", "slow-start"]},
+                "progress_percent": {"type": "integer", "minimum": 0, "maximum": 100},
+                "remaining_seconds": {"type": "integer", "minimum": 0}
+            }
+        },
+        "maintenance": {
+            "type": "object",
+            "properties": {
+                "reason": {"type": "string"},
+                "owner": {"type": "string"},
+                "ticket": {"type": "string"},
+                "until": {"type": "integer", "description": "Expiry, unix time in seconds"},
+                "mode": {"enum": ["drain", "hard"]}
+            }
+        },
+        "time": {"type": "integer", "description": "Unix time in seconds"},
+        "uptime_seconds": {"type": "integer", "minimum": 0},
+        "node": {
+            "type": "object",
+            "required": ["version", "start_time"],
+            "properties": {
+                "id": {"type": "string", "description": "Configured node ID"},
+                "boot_id": {"type": "string", "description": "Changes on every reboot"},
+                "machine_id": {"type": "string"},
+                "version": {"type": "string", "description": "Server version"},
+                "start_time": {"type": "integer", "description": "Start of the process, unix time in seconds"}
+            }
+        },
+        "labels": {
+            "type": "object",
+            "additionalProperties": {"type": "string"},
+            "description": "Labels from the server configuration"
+        },
+        "collectors": {
+            "type": "object",
+            "properties": {
+                "net": {
+                    "allOf": [{"$ref": "#/definitions/collector"}],
+                    "required": ["interface", "bandwidth_bps", "threshold_bps", "utilization_percent", "weight"],
+                    "properties": {
+                        "interface": {"type": "string"},
+                        "bandwidth_bps": {"type": "integer", "minimum": 0, "description": "Bits per second"},
+                        "threshold_bps": {"type": "integer", "minimum": 0, "description": "Bits per second"},
+                        "utilization_percent": {"type": "integer", "minimum": 0},
+                        "weight": {"type": "integer", "minimum": 0, "maximum": 100}
+                    }
+                },
+                "load": {
+                    "allOf": [{"$ref": "#/definitions/collector"}],
+                    "required": ["load1", "load5", "load15", "threshold", "weight"],
+                    "properties": {
+                        "load1": {"type": "number", "minimum": 0},
+                        "load5": {"type": "number", "minimum": 0},
+                        "load15": {"type": "number", "minimum": 0},
+                        "threshold": {"type": "number", "minimum": 0, "description": "0 when disabled"},
+                        "weight": {"type": "integer", "minimum": 0, "maximum": 100}
+                    }
+                },
+                "hostname": {
+                    "allOf": [{"$ref": "#/definitions/collector"}],
+                    "required": ["hostname"],
+                    "properties": {
+                        "hostname": {"type": "string"}
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "collector": {
+            "type": "object",
+            "required": ["state", "age_seconds", "errors"],
+            "properties": {
+                "state": {"enum": ["ok", "unknown"]},
+                "age_seconds": {"type": "integer", "minimum": 0},
+                "errors": {"type": "integer", "minimum": 0},
+                "last_error": {"type": "string"}
+            }
+        }
+    }
+}
+`
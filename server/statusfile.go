@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// Formats of the status file
+var statusFileFormats = map[string]bool{"json": true, "text": true, "token": true}
+
+// WriteFileAtomic replaces the file at path with data, so that readers never
+// see a partially written file. The group is left as is if gid is -1.
+func WriteFileAtomic(path string, data []byte, mode os.FileMode, gid int) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if gid != -1 {
+		if err := tmp.Chown(-1, gid); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WriteStatusFile writes the snapshot to the status file, as JSON, as
+// key=value lines, or as a single free or busy token.
+func WriteStatusFile(c *Config, snap *Snapshot) error {
+	var data []byte
+	var err error
+	switch c.StatusFileFormat {
+	case "json":
+		// Copied, as the snapshot is shared and must not be changed
+		data = append(append([]byte{}, snap.JSON...), '\n')
+	case "text":
+		data, err = snap.Encoded("text")
+	case "token":
+		data = []byte("busy\n")
+		if snap.Status.Free {
+			data = []byte("free\n")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(c.StatusFile, data, c.StatusFileMode, c.StatusFileGroup)
+}
+
+// lookupGroup returns the ID of a group given by name or ID, or -1 for none.
+func lookupGroup(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, errors.New("invalid group ID: " + g.Gid)
+	}
+	return gid, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStatusFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statusfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.Store(&Config{Interval: 3600})
+	if err := Publish(benchmarkStatus()); err != nil {
+		t.Fatal(err)
+	}
+	snap := CurrentSnapshot()
+	published := append([]byte{}, snap.JSON...)
+
+	for _, test := range []struct {
+		format   string
+		expected []byte
+	}{
+		{"json", append(append([]byte{}, published...), '\n')},
+		{"token", []byte("free\n")},
+	} {
+		c := &Config{
+			StatusFile:       filepath.Join(dir, "status"),
+			StatusFileFormat: test.format,
+			StatusFileMode:   0640,
+			StatusFileGroup:  -1,
+		}
+		if err := WriteStatusFile(c, snap); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(c.StatusFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, test.expected) {
+			t.Errorf("%s: got %q, expected %q", test.format, data, test.expected)
+		}
+		if fi, err := os.Stat(c.StatusFile); err != nil || fi.Mode().Perm() != 0640 {
+			t.Errorf("%s: got mode %v, expected 0640", test.format, fi.Mode().Perm())
+		}
+	}
+
+	// The snapshot is shared, and must not have been written to
+	if !bytes.Equal(snap.JSON, published) {
+		t.Error("the published JSON was changed")
+	}
+	if cap(snap.JSON) > len(snap.JSON) && snap.JSON[:len(snap.JSON)+1][len(snap.JSON)] == '\n' {
+		t.Error("a newline was written past the published JSON")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Longest a long poll waits for an update
+const maxWait = 60 * time.Second
+
+// Interval of the comments keeping idle streams open
+const streamKeepalive = 15 * time.Second
+
+// closing is closed when the server shuts down, to end the streams and long
+// polls that would otherwise hold up the shutdown.
+var closing = make(chan struct{})
+
+// WaitSnapshot returns the first snapshot that changed after generation, or
+// the current snapshot once the timeout has passed or ctx is done. A
+// generation ahead of the current one is from another run, so the current
+// snapshot is returned right away.
+func WaitSnapshot(ctx context.Context, generation uint64, timeout time.Duration) *Snapshot {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		snap := CurrentSnapshot()
+		if snap.Changed > generation || generation > snap.Generation {
+			return snap
+		}
+		select {
+		case <-snap.Updated():
+		case <-timer.C:
+			return snap
+		case <-ctx.Done():
+			return snap
+		case <-closing:
+			return snap
+		}
+	}
+}
+
+// waitSnapshot returns the snapshot to respond with. With the wait parameter,
+// the request is held until the status has changed since the generation in
+// the since parameter, which defaults to the current one.
+func waitSnapshot(r *http.Request) (*Snapshot, error) {
+	snap := CurrentSnapshot()
+	if r.URL.Query().Get("wait") == "" {
+		return snap, nil
+	}
+
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait < 0 {
+		return nil, fmt.Errorf("invalid wait: %v", r.URL.Query().Get("wait"))
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	since := snap.Generation
+	if s := r.URL.Query().Get("since"); s != "" {
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid since: %v", s)
+		}
+	}
+	return WaitSnapshot(r.Context(), since, wait), nil
+}
+
+// streamHandler sends the status as Server-Sent Events, one per snapshot. A
+// client reconnecting with the Last-Event-ID of the current snapshot does
+// not get it again.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	snap := CurrentSnapshot()
+	send := r.Header.Get("Last-Event-ID") != strconv.FormatUint(snap.Generation, 10)
+	for {
+		if send {
+			if err := writeEvent(w, snap); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+		select {
+		case <-snap.Updated():
+			snap = CurrentSnapshot()
+			send = true
+		case <-keepalive.C:
+			// The worker has stopped publishing, so tell the client
+			if snap.Status.Stale() {
+				if err := writeEvent(w, snap); err != nil {
+					return
+				}
+			} else {
+				fmt.Fprint(w, ": keepalive\n\n")
+			}
+			flusher.Flush()
+			send = false
+		case <-r.Context().Done():
+			return
+		case <-closing:
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, snap *Snapshot) error {
+	var data []byte
+	var err error
+	if snap.Status.Stale() {
+		s := staleStatus(snap.Status)
+		data, err = formats["compact"].Encode(&s)
+	} else {
+		data, err = snap.Encoded("compact")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", snap.Generation, data)
+	return err
+}
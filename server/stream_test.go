@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitSnapshot(t *testing.T) {
+	config.Store(&Config{Interval: 3600})
+	s := benchmarkStatus()
+	s.Reason = "Wait test"
+	if err := Publish(s); err != nil {
+		t.Fatal(err)
+	}
+	current := CurrentSnapshot().Generation
+
+	// A tick without a change does not end the wait
+	s.Time++
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		Publish(s)
+	}()
+
+	tests := []struct {
+		name       string
+		generation uint64
+		wait       bool
+	}{
+		{"current", current, true},
+		{"older", current - 1, false},
+		{"from another run", current + 5, false},
+	}
+
+	for _, test := range tests {
+		start := time.Now()
+		snap := WaitSnapshot(context.Background(), test.generation, 100*time.Millisecond)
+		waited := time.Since(start) >= 100*time.Millisecond
+		if waited != test.wait {
+			t.Errorf("%s: waited %v", test.name, time.Since(start))
+		}
+		if snap.Changed != current {
+			t.Errorf("%s: got a change at %d, expected %d", test.name, snap.Changed, current)
+		}
+	}
+}
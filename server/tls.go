@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate, and reloads it when the certificate or
+// key file has been modified. A certificate that fails to load is logged, and
+// the current one is kept.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+	sync.Mutex
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	modified, err := r.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modified); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modTime returns the latest modification time of the certificate and key.
+func (r *CertReloader) modTime() (time.Time, error) {
+	var modified time.Time
+	for _, file := range []string{r.CertFile, r.KeyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+		if fi.ModTime().After(modified) {
+			modified = fi.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+func (r *CertReloader) load(modified time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modified = modified
+	return nil
+}
+
+// GetCertificate is for tls.Config. The files are checked at most once a
+// second.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) < time.Second {
+		return r.cert, nil
+	}
+	r.checked = now
+
+	modified, err := r.modTime()
+	if err != nil || modified.Equal(r.modified) {
+		return r.cert, nil
+	}
+	if err := r.load(modified); err != nil {
+		log.Println("Unable to reload certificate, keeping the current one:", err)
+		// Do not retry until the files are modified again
+		r.modified = modified
+		return r.cert, nil
+	}
+	log.Println("Certificate reloaded")
+	return r.cert, nil
+}
+
+// TLSConfig returns the TLS configuration of the listener, or nil if TLS is
+// not enabled. With a client CA bundle, clients must present a certificate
+// issued by it and matching the allowed patterns.
+func TLSConfig(l *ListenerConfig) (*tls.Config, error) {
+	if l.TLSCert == "" {
+		return nil, nil
+	}
+
+	reloader, err := NewCertReloader(l.TLSCert, l.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if l.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(l.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + l.TLSClientCA)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		tc.VerifyPeerCertificate = verifyClient(l.Name)
+	}
+	return tc, nil
+}
+
+// verifyClient checks the verified client certificate against the allowed
+// patterns of the listener, which are looked up on every connection as they
+// may have been reloaded.
+func verifyClient(name string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		l := Conf().Listener(name)
+		if l == nil || len(l.TLSClientAllow) == 0 {
+			return nil
+		}
+		if len(verifiedChains) > 0 && CertMatches(verifiedChains[0][0], l.TLSClientAllow) {
+			return nil
+		}
+		return errors.New("client certificate not allowed")
+	}
+}
+
+// CertMatches returns true if the subject common name or one of the subject
+// alternative names of cert matches one of the shell patterns.
+func CertMatches(cert *x509.Certificate, patterns []string) bool {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok && name != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
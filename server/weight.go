@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A curve maps the headroom of a metric (0-100) to a capacity score (0-100).
+type curve func(headroom float64) float64
+
+var curveTable = map[string]curve{
+	// The score follows the headroom.
+	"linear": func(h float64) float64 {
+		return h
+	},
+	// The score drops early, backing off well before the threshold.
+	"square": func(h float64) float64 {
+		return h * h / 100
+	},
+	// The score stays high until the metric gets close to the threshold.
+	"sqrt": func(h float64) float64 {
+		return 10 * math.Sqrt(h)
+	},
+}
+
+func ParseCurve(s string) (curve, error) {
+	if c, ok := curveTable[strings.ToLower(strings.TrimSpace(s))]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown curve: %v", s)
+}
+
+// Headroom returns how much of the threshold is left, in percent. A threshold
+// of zero disables the metric, which then always has full headroom.
+func Headroom(value float64, threshold float64) float64 {
+	if threshold <= 0 {
+		return 100
+	}
+	h := 100 - 100*value/threshold
+	if h < 0 {
+		return 0
+	}
+	if h > 100 {
+		return 100
+	}
+	return h
+}
+
+// Weight converts a score from a curve to the integer weight that is
+// published. Any headroom at all gives a weight of at least 1.
+func Weight(score float64) int {
+	return int(math.Ceil(math.Min(100, math.Max(0, score))))
+}